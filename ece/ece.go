@@ -0,0 +1,414 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ece implements the "aes128gcm" Encrypted Content-Encoding for HTTP
+// described in RFC 8188.
+//
+// Content is split into records of a fixed size, each of which is encrypted
+// separately, so that arbitrarily large content can be encrypted and decrypted
+// as a stream:
+//
+//	w, err := ece.NewWriter(body, key, nil, ece.DefaultRecordSize, []byte("key-1"))
+//	io.Copy(w, content)
+//	w.Close()
+//
+//	r, err := ece.NewReader(body, func(keyid []byte) ([]byte, error) {
+//	  return keys[string(keyid)], nil
+//	})
+//	io.Copy(content, r)
+//
+// The Web Push message encryption in the webpush package is built on top of
+// this package.
+package ece
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	// SaltSize is the length of the salt at the start of the header.
+	SaltSize = 16
+	// MinRecordSize is the smallest valid record size. A record must be able to
+	// hold the 16 octet authentication tag, the delimiter and one octet of data.
+	MinRecordSize = 18
+	// DefaultRecordSize is the record size used by RFC 8188's examples, and the
+	// largest a Web Push service is required to accept.
+	DefaultRecordSize = 4096
+	// MaxKeyIDLength is the longest key identifier the header can carry.
+	MaxKeyIDLength = 255
+
+	tagSize = 16
+	// The header is salt (16) || rs (4) || idlen (1) || keyid (idlen)
+	headerPrefixLength = SaltSize + 4 + 1
+
+	// Records other than the last end with this delimiter.
+	recordDelimiter = 0x01
+	// The last record ends with this delimiter.
+	lastRecordDelimiter = 0x02
+)
+
+var (
+	cekInfo   = []byte("Content-Encoding: aes128gcm\x00")
+	nonceInfo = []byte("Content-Encoding: nonce\x00")
+
+	// ErrTruncated is returned by a Reader when the content ends before the last
+	// record, which is how an attacker would drop records from the end.
+	ErrTruncated = errors.New("ece: content is truncated")
+	// ErrClosed is returned when writing to a closed Writer.
+	ErrClosed = errors.New("ece: write to closed writer")
+
+	// Generate a random salt when none is given. Overridable for testing.
+	randomSalt = func() ([]byte, error) {
+		salt := make([]byte, SaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		return salt, nil
+	}
+)
+
+// KeyLookup returns the input keying material for the key identifier found in
+// the header of encrypted content.
+type KeyLookup func(keyid []byte) ([]byte, error)
+
+// Writer encrypts everything written to it and writes the encrypted content
+// to the underlying writer. Close must be called to write the last record.
+type Writer struct {
+	w      io.Writer
+	gcm    cipher.AEAD
+	nonce  []byte
+	header []byte
+	// The amount of plaintext that fits in a record.
+	capacity int
+	buf      []byte
+	seq      uint64
+	closed   bool
+	err      error
+}
+
+// NewWriter returns a Writer that encrypts using the input keying material key
+// and writes to w. The salt must be 16 octets, or nil to use a random salt.
+// The record size rs is the size of each encrypted record, including its 17
+// octets of overhead. The keyid is written to the header so that the reader
+// can find the key, and may be empty.
+func NewWriter(w io.Writer, key, salt []byte, rs int, keyid []byte) (*Writer, error) {
+	if len(key) == 0 {
+		return nil, errors.New("ece: key must not be empty")
+	}
+	if rs < MinRecordSize || int64(rs) > math.MaxUint32 {
+		return nil, fmt.Errorf("ece: record size %d is out of range", rs)
+	}
+	if len(keyid) > MaxKeyIDLength {
+		return nil, fmt.Errorf("ece: key id is %d octets, the max is %d", len(keyid), MaxKeyIDLength)
+	}
+	if salt == nil {
+		var err error
+		if salt, err = randomSalt(); err != nil {
+			return nil, err
+		}
+	}
+	if len(salt) != SaltSize {
+		return nil, fmt.Errorf("ece: salt must be %d octets, was %d", SaltSize, len(salt))
+	}
+
+	gcm, nonce, err := deriveKeys(key, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, headerPrefixLength, headerPrefixLength+len(keyid))
+	copy(header, salt)
+	binary.BigEndian.PutUint32(header[SaltSize:], uint32(rs))
+	header[SaltSize+4] = byte(len(keyid))
+	header = append(header, keyid...)
+
+	return &Writer{
+		w:        w,
+		gcm:      gcm,
+		nonce:    nonce,
+		header:   header,
+		capacity: rs - tagSize - 1,
+	}, nil
+}
+
+// Write encrypts p. Records are only written once they are full, or when the
+// Writer is closed.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, ErrClosed
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	w.buf = append(w.buf, p...)
+	// Only write a record once we know it isn't the last one, as the last
+	// record has a different delimiter.
+	for len(w.buf) > w.capacity {
+		if err := w.writeRecord(w.buf[:w.capacity], recordDelimiter); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[:copy(w.buf, w.buf[w.capacity:])]
+	}
+	return len(p), nil
+}
+
+// Close writes the last record. It does not close the underlying writer.
+func (w *Writer) Close() error {
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+	if w.err != nil {
+		return w.err
+	}
+	return w.writeRecord(w.buf, lastRecordDelimiter)
+}
+
+func (w *Writer) writeRecord(plaintext []byte, delimiter byte) error {
+	var out []byte
+	if w.header != nil {
+		out = w.header
+		w.header = nil
+	}
+
+	data := make([]byte, len(plaintext)+1, len(plaintext)+1+tagSize)
+	copy(data, plaintext)
+	data[len(plaintext)] = delimiter
+	out = w.gcm.Seal(out, recordNonce(w.nonce, w.seq), data, nil)
+	w.seq++
+
+	if _, err := w.w.Write(out); err != nil {
+		w.err = err
+		return err
+	}
+	return nil
+}
+
+// Reader decrypts content read from an underlying reader.
+type Reader struct {
+	r     *bufio.Reader
+	salt  []byte
+	rs    int
+	keyid []byte
+	gcm   cipher.AEAD
+	nonce []byte
+	seq   uint64
+	// Encrypted record being read, and the decrypted data not yet returned.
+	record bytes.Buffer
+	plain  []byte
+	done   bool
+	err    error
+}
+
+// NewReader reads the header from r and uses keyLookup to find the input
+// keying material for the key identifier in it.
+func NewReader(r io.Reader, keyLookup KeyLookup) (*Reader, error) {
+	br := bufio.NewReader(r)
+
+	prefix := make([]byte, headerPrefixLength)
+	if _, err := io.ReadFull(br, prefix); err != nil {
+		return nil, headerError(err)
+	}
+	rs := binary.BigEndian.Uint32(prefix[SaltSize:])
+	if rs < MinRecordSize {
+		return nil, fmt.Errorf("ece: record size %d is less than %d", rs, MinRecordSize)
+	}
+	keyid := make([]byte, prefix[SaltSize+4])
+	if _, err := io.ReadFull(br, keyid); err != nil {
+		return nil, headerError(err)
+	}
+
+	key, err := keyLookup(keyid)
+	if err != nil {
+		return nil, err
+	}
+	gcm, nonce, err := deriveKeys(key, prefix[:SaltSize])
+	if err != nil {
+		return nil, err
+	}
+
+	return &Reader{
+		r:     br,
+		salt:  prefix[:SaltSize],
+		rs:    int(rs),
+		keyid: keyid,
+		gcm:   gcm,
+		nonce: nonce,
+	}, nil
+}
+
+// Salt returns the salt from the header.
+func (r *Reader) Salt() []byte { return r.salt }
+
+// RecordSize returns the record size from the header.
+func (r *Reader) RecordSize() int { return r.rs }
+
+// KeyID returns the key identifier from the header.
+func (r *Reader) KeyID() []byte { return r.keyid }
+
+// Read decrypts the next part of the content. It returns ErrTruncated if the
+// content ends without a last record.
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.done {
+			return 0, io.EOF
+		}
+		r.err = r.readRecord()
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+func (r *Reader) readRecord() error {
+	// The record size comes from the header, which could claim up to 4 GiB,
+	// so the buffer only grows as data actually arrives.
+	r.record.Reset()
+	n, err := r.record.ReadFrom(io.LimitReader(r.r, int64(r.rs)))
+	switch {
+	case err != nil:
+		return err
+	case n == 0:
+		return ErrTruncated
+	case n < int64(r.rs):
+		r.done = true
+	default:
+		// A full record is the last one if nothing follows it.
+		if _, err := r.r.Peek(1); err == io.EOF {
+			r.done = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	record := r.record.Bytes()
+	plain, err := r.gcm.Open(record[:0], recordNonce(r.nonce, r.seq), record, nil)
+	if err != nil {
+		return fmt.Errorf("ece: record %d: %v", r.seq, err)
+	}
+	r.seq++
+
+	// Strip the padding, which is any number of zeros after the delimiter.
+	i := len(plain) - 1
+	for i >= 0 && plain[i] == 0 {
+		i--
+	}
+	if i < 0 {
+		return fmt.Errorf("ece: record %d has no delimiter", r.seq-1)
+	}
+	switch {
+	case plain[i] == lastRecordDelimiter && !r.done:
+		// A last record followed by more content means records were added.
+		return fmt.Errorf("ece: record %d is marked last but more content follows", r.seq-1)
+	case plain[i] == recordDelimiter && r.done:
+		return ErrTruncated
+	case plain[i] != recordDelimiter && plain[i] != lastRecordDelimiter:
+		return fmt.Errorf("ece: record %d has invalid delimiter 0x%02x", r.seq-1, plain[i])
+	}
+	r.plain = plain[:i]
+	return nil
+}
+
+// Encrypt is a convenience wrapper around Writer that encrypts plaintext in
+// one go.
+func Encrypt(plaintext, key, salt []byte, rs int, keyid []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, key, salt, rs, keyid)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decrypt is a convenience wrapper around Reader that decrypts content in one
+// go.
+func Decrypt(content []byte, keyLookup KeyLookup) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(content), keyLookup)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func headerError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errors.New("ece: content is shorter than its header")
+	}
+	return err
+}
+
+// Derive the content encryption key and base nonce from the input keying
+// material and salt, as described in section 2.2 and 2.3 of RFC 8188.
+func deriveKeys(key, salt []byte) (cipher.AEAD, []byte, error) {
+	prk := hkdfExtract(salt, key)
+	c, err := aes.NewCipher(hkdfExpand(prk, cekInfo, 16))
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := cipher.NewGCM(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	return gcm, hkdfExpand(prk, nonceInfo, 12), nil
+}
+
+// The nonce for a record is the base nonce XOR the record sequence number.
+func recordNonce(nonce []byte, seq uint64) []byte {
+	n := make([]byte, len(nonce))
+	copy(n, nonce)
+	for i := 0; i < 8; i++ {
+		n[len(n)-1-i] ^= byte(seq >> (8 * uint(i)))
+	}
+	return n
+}
+
+// HKDF as described in https://www.rfc-editor.org/rfc/rfc5869.txt, limited to
+// outputs of a single block as that is all RFC 8188 needs.
+func hkdfExtract(salt, ikm []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	return mac.Sum(nil)
+}
+
+func hkdfExpand(prk, info []byte, length int) []byte {
+	mac := hmac.New(sha256.New, prk)
+	mac.Write(info)
+	mac.Write([]byte{1})
+	return mac.Sum(nil)[:length]
+}
@@ -0,0 +1,230 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ece
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+var b64 = base64.URLEncoding.WithPadding(base64.NoPadding)
+
+func staticKey(key []byte) KeyLookup {
+	return func([]byte) ([]byte, error) { return key, nil }
+}
+
+// TestRFCSingleRecord uses the example from section 3.1 of RFC 8188.
+func TestRFCSingleRecord(t *testing.T) {
+	key, _ := b64.DecodeString("yqdlZ-tYemfogSmv7Ws5PQ")
+	salt, _ := b64.DecodeString("I1BsxtFttlv3u_Oo94xnmw")
+	expected := "I1BsxtFttlv3u_Oo94xnmwAAEAAA-NAVub2qFgBEuQKRapoZu-IxkIva3MEB1PD-ly8Thjg"
+
+	content, err := Encrypt([]byte("I am the walrus"), key, salt, 4096, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b64.EncodeToString(content) != expected {
+		t.Errorf("Content was %v, expected %v", b64.EncodeToString(content), expected)
+	}
+
+	plaintext, err := Decrypt(content, staticKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "I am the walrus" {
+		t.Errorf("Plaintext was %q", plaintext)
+	}
+}
+
+// TestRFCMultipleRecords uses the example from section 3.2 of RFC 8188, which
+// also has padding and a key id.
+func TestRFCMultipleRecords(t *testing.T) {
+	key, _ := b64.DecodeString("BO3ZVPxUlnLORbVGMpbT1Q")
+	content, _ := b64.DecodeString("uNCkWiNYzKTnBN9ji3-qWAAAABkCYTHOG8chz_gnvgOqdGYovxyjuqRyJFjEDyoF1Fvkj6hQPdPHI51OEUKEpgz3SsLWIqS_uA")
+
+	var id []byte
+	plaintext, err := Decrypt(content, func(keyid []byte) ([]byte, error) {
+		id = keyid
+		return key, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "I am the walrus" {
+		t.Errorf("Plaintext was %q", plaintext)
+	}
+	if string(id) != "a1" {
+		t.Errorf("Key id was %q, expected a1", id)
+	}
+}
+
+func TestStreaming(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	plaintext := []byte(strings.Repeat("The quick brown fox jumps over the lazy dog. ", 1000))
+
+	for _, rs := range []int{MinRecordSize, 25, 100, DefaultRecordSize, len(plaintext) + 17} {
+		var buf bytes.Buffer
+		w, err := NewWriter(&buf, key, nil, rs, []byte("id"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Write in uneven pieces to exercise the buffering.
+		for rest := plaintext; len(rest) > 0; {
+			n := 7
+			if n > len(rest) {
+				n = len(rest)
+			}
+			if _, err := w.Write(rest[:n]); err != nil {
+				t.Fatal(err)
+			}
+			rest = rest[n:]
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte("x")); err != ErrClosed {
+			t.Errorf("Expected ErrClosed writing after Close, got %v", err)
+		}
+
+		r, err := NewReader(&buf, staticKey(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.RecordSize() != rs || string(r.KeyID()) != "id" || len(r.Salt()) != SaltSize {
+			t.Errorf("Unexpected header: rs %d, keyid %q, salt %v", r.RecordSize(), r.KeyID(), r.Salt())
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("rs %d: %v", rs, err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Errorf("rs %d: decrypted content does not match", rs)
+		}
+	}
+}
+
+func TestEmptyContent(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	content, err := Encrypt(nil, key, nil, DefaultRecordSize, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// header, then one record with just the delimiter and the tag
+	if len(content) != headerPrefixLength+1+tagSize {
+		t.Errorf("Content length was %d", len(content))
+	}
+	plaintext, err := Decrypt(content, staticKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plaintext) != 0 {
+		t.Errorf("Plaintext was %q, expected nothing", plaintext)
+	}
+}
+
+func TestTamperedContent(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	rs := 50
+	content, err := Encrypt([]byte(strings.Repeat("a", 100)), key, nil, rs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 100 octets of plaintext at 33 octets per record is 4 records.
+	records := content[headerPrefixLength:]
+	if len(records) != 3*rs+1+1+tagSize {
+		t.Fatalf("Unexpected content length %d", len(content))
+	}
+
+	if _, err := Decrypt(content[:headerPrefixLength+2*rs], staticKey(key)); err != ErrTruncated {
+		t.Errorf("Expected ErrTruncated when dropping records, got %v", err)
+	}
+	if _, err := Decrypt(content[:headerPrefixLength], staticKey(key)); err != ErrTruncated {
+		t.Errorf("Expected ErrTruncated with no records, got %v", err)
+	}
+	if _, err := Decrypt(content[:10], staticKey(key)); err == nil {
+		t.Error("Expected an error with a short header")
+	}
+
+	swapped := append([]byte{}, content[:headerPrefixLength]...)
+	swapped = append(swapped, records[rs:2*rs]...)
+	swapped = append(swapped, records[:rs]...)
+	swapped = append(swapped, records[2*rs:]...)
+	if _, err := Decrypt(swapped, staticKey(key)); err == nil {
+		t.Error("Expected an error when records are reordered")
+	}
+
+	if _, err := Decrypt(content, staticKey([]byte("fedcba9876543210"))); err == nil {
+		t.Error("Expected an error with the wrong key")
+	}
+}
+
+func TestInvalidParameters(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	if _, err := NewWriter(ioutil.Discard, key, nil, MinRecordSize-1, nil); err == nil {
+		t.Error("Expected an error due to small record size")
+	}
+	if _, err := NewWriter(ioutil.Discard, key, []byte("short"), DefaultRecordSize, nil); err == nil {
+		t.Error("Expected an error due to short salt")
+	}
+	if _, err := NewWriter(ioutil.Discard, key, nil, DefaultRecordSize, make([]byte, 256)); err == nil {
+		t.Error("Expected an error due to long key id")
+	}
+	if _, err := NewWriter(ioutil.Discard, nil, nil, DefaultRecordSize, nil); err == nil {
+		t.Error("Expected an error due to missing key")
+	}
+
+	// A header with a record size of 17
+	header := append(make([]byte, SaltSize), 0, 0, 0, 17, 0)
+	if _, err := NewReader(bytes.NewReader(header), staticKey(key)); err == nil {
+		t.Error("Expected an error due to small record size in header")
+	}
+
+	if _, err := NewReader(bytes.NewReader(header[:SaltSize]), staticKey(key)); err == nil {
+		t.Error("Expected an error due to truncated header")
+	}
+}
+
+func TestHugeRecordSize(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	content, err := Encrypt([]byte("hello"), key, nil, DefaultRecordSize, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The record size isn't part of the key derivation, so a single record
+	// shorter than it still decrypts with the largest record size.
+	copy(content[SaltSize:], []byte{0xff, 0xff, 0xff, 0xff})
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	plaintext, err := Decrypt(content, staticKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decrypt(content[:headerPrefixLength+3], staticKey(key)); err == nil {
+		t.Error("Expected an error for a short record")
+	}
+	runtime.ReadMemStats(&after)
+
+	if string(plaintext) != "hello" {
+		t.Errorf("Plaintext was %q, expected hello", plaintext)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("Expected the buffer to grow with the data, but %d bytes were allocated", allocated)
+	}
+}
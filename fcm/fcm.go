@@ -0,0 +1,269 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fcm sends messages to browser push subscriptions through the
+// Firebase Cloud Messaging HTTP v1 API, as an alternative to sending them to
+// the subscription's endpoint with webpush.Send. FCM encrypts the message
+// itself, and the request is authorized with an OAuth2 access token for a
+// service account rather than with VAPID.
+//
+//	sa, err := fcm.ServiceAccountFromJSON(keyFile)
+//	c := fcm.NewClient(sa.ProjectID, sa)
+//	result, err := c.Send(ctx, sub, "Hello", &webpush.Options{TTL: 3600})
+//
+// Only subscriptions whose endpoint is on fcm.googleapis.com can be sent to.
+package fcm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+
+	"github.com/googlechrome/push-encryption-go/webpush"
+)
+
+const (
+	// DefaultBaseURL is the FCM server.
+	DefaultBaseURL = "https://fcm.googleapis.com"
+
+	// MessageKey is the key of the webpush data that holds the message.
+	MessageKey = "message"
+
+	// maxResponseLength limits how much of a response is read.
+	maxResponseLength = 64 << 10
+)
+
+// Client sends messages with the FCM HTTP v1 API.
+type Client struct {
+	// ProjectID is the Firebase project to send messages as.
+	ProjectID string
+	// TokenSource authorizes the requests, usually a *ServiceAccount.
+	TokenSource TokenSource
+	// BaseURL is the FCM server. If empty, DefaultBaseURL is used.
+	BaseURL string
+	// Client makes the requests. If nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+// NewClient returns a Client for the project.
+func NewClient(projectID string, ts TokenSource) *Client {
+	return &Client{ProjectID: projectID, TokenSource: ts}
+}
+
+// RegistrationToken returns the FCM registration token of a subscription's
+// endpoint, which is the last path segment of an endpoint on
+// fcm.googleapis.com.
+func RegistrationToken(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	dir, token := path.Split(u.Path)
+	if u.Host != "fcm.googleapis.com" || token == "" || (dir != "/fcm/send/" && dir != "/wp/") {
+		return "", fmt.Errorf("fcm: %s is not an FCM endpoint", endpoint)
+	}
+	return token, nil
+}
+
+// The request body of projects.messages.send.
+type sendRequest struct {
+	Message message `json:"message"`
+}
+
+type message struct {
+	Token   string        `json:"token"`
+	Webpush webpushConfig `json:"webpush"`
+}
+
+type webpushConfig struct {
+	Headers map[string]string `json:"headers,omitempty"`
+	Data    map[string]string `json:"data,omitempty"`
+}
+
+// Result is FCM's response to a message.
+type Result struct {
+	StatusCode int
+	// Name identifies the message, in the form
+	// projects/{project}/messages/{id}.
+	Name string
+	// ServiceError describes why FCM rejected the message. It is nil unless
+	// the status code is 400 or more.
+	ServiceError *webpush.PushServiceError
+}
+
+// The error response of Google APIs.
+type errorResponse struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+		Details []struct {
+			Type      string `json:"@type"`
+			ErrorCode string `json:"errorCode"`
+		} `json:"details"`
+	} `json:"error"`
+}
+
+// Send sends the message to the subscription, which is delivered to the
+// service worker as the MessageKey field of the push event's data. TTL,
+// Urgency and Topic are taken from opts, the subscription's endpoint is
+// checked with EndpointPolicy, and the message is signed with PayloadSigner if
+// it is set. Token, VAPID and VAPIDKeys are ignored, as FCM authenticates the
+// request with the TokenSource instead. ReceiptURI is rejected, as delivery
+// receipts aren't supported, and so is Compress, as FCM carries the message
+// as a string and compressed messages are binary. An error is only returned
+// if the request couldn't be made, not for error status codes.
+func (c *Client) Send(ctx context.Context, sub *webpush.Subscription, msg string, opts *webpush.Options) (*Result, error) {
+	if opts == nil {
+		opts = &webpush.Options{}
+	}
+	if opts.ReceiptURI != "" {
+		return nil, errors.New("fcm: delivery receipts are not supported")
+	}
+	if opts.Compress {
+		return nil, errors.New("fcm: compressed messages are not supported")
+	}
+	if c.TokenSource == nil {
+		return nil, errors.New("fcm: client has no TokenSource")
+	}
+
+	if err := checkEndpoint(sub.Endpoint, opts.EndpointPolicy); err != nil {
+		return nil, err
+	}
+	token, err := RegistrationToken(sub.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if opts.PayloadSigner != nil && msg != "" {
+		if msg, err = opts.PayloadSigner.SignPayload(sub, msg); err != nil {
+			return nil, err
+		}
+	}
+	h, err := headers(opts)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(sendRequest{message{
+		Token:   token,
+		Webpush: webpushConfig{Headers: h, Data: map[string]string{MessageKey: msg}},
+	}})
+	if err != nil {
+		return nil, err
+	}
+
+	accessToken, err := c.TokenSource.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	baseURL := c.BaseURL
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+	req, err := http.NewRequest("POST", baseURL+"/v1/projects/"+c.ProjectID+"/messages:send", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseLength))
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{StatusCode: resp.StatusCode}
+	if resp.StatusCode >= 400 {
+		result.ServiceError = parseError(resp.StatusCode, respBody)
+		return result, nil
+	}
+	var sent struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(respBody, &sent); err != nil {
+		return nil, fmt.Errorf("fcm: invalid response: %v", err)
+	}
+	result.Name = sent.Name
+	return result, nil
+}
+
+// checkEndpoint checks an endpoint with the policy, or with
+// webpush.DefaultEndpointPolicy if it is nil.
+func checkEndpoint(endpoint string, policy webpush.EndpointPolicy) error {
+	if policy == nil {
+		policy = webpush.DefaultEndpointPolicy
+	}
+	req, err := http.NewRequest("POST", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	return policy.CheckEndpoint(req)
+}
+
+// headers returns the Web Push headers that FCM should send with the message.
+func headers(opts *webpush.Options) (map[string]string, error) {
+	if opts.TTL < 0 {
+		return nil, fmt.Errorf("fcm: TTL must not be negative, was %d", opts.TTL)
+	}
+	h := map[string]string{"TTL": strconv.Itoa(opts.TTL)}
+	if opts.Urgency != "" {
+		if opts.Urgency.Rank() < 0 {
+			return nil, fmt.Errorf("fcm: unknown urgency %q", opts.Urgency)
+		}
+		h["Urgency"] = string(opts.Urgency)
+	}
+	if opts.Topic != "" {
+		if !webpush.ValidTopic(opts.Topic) {
+			return nil, fmt.Errorf("fcm: invalid topic %q", opts.Topic)
+		}
+		h["Topic"] = opts.Topic
+	}
+	return h, nil
+}
+
+// parseError reads the error of a failed request. The code is the FCM error
+// code, such as UNREGISTERED, or else the status of the Google API error.
+func parseError(status int, body []byte) *webpush.PushServiceError {
+	e := &webpush.PushServiceError{StatusCode: status}
+	var er errorResponse
+	if json.Unmarshal(body, &er) != nil {
+		e.Message = http.StatusText(status)
+		return e
+	}
+	e.Code, e.Message = er.Error.Status, er.Error.Message
+	for _, d := range er.Error.Details {
+		if d.ErrorCode != "" {
+			e.Code = d.ErrorCode
+		}
+	}
+	return e
+}
@@ -0,0 +1,209 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fcm
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/googlechrome/push-encryption-go/webpush"
+)
+
+// newFCMStub returns an FCM server that accepts messages for the registration
+// token "good" with the access token "token1".
+func newFCMStub(t *testing.T, received *sendRequest) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path != "/v1/projects/test-project/messages:send" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer token1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error": {"code": 401, "message": "Request had invalid authentication credentials.", "status": "UNAUTHENTICATED"}}`)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(received); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if received.Message.Token != "good" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error": {"code": 404, "message": "Requested entity was not found.", "status": "NOT_FOUND", "details": [{"@type": "type.googleapis.com/google.firebase.fcm.v1.FcmError", "errorCode": "UNREGISTERED"}]}}`)
+			return
+		}
+		fmt.Fprint(w, `{"name": "projects/test-project/messages/0:1500415314455276%31bd1c9631bd1c96"}`)
+	}))
+}
+
+func TestSend(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var issued int
+	oauth := newOAuthStub(t, key, &issued)
+	defer oauth.Close()
+	var received sendRequest
+	server := newFCMStub(t, &received)
+	defer server.Close()
+
+	sa, err := ServiceAccountFromJSON(testServiceAccountJSON(t, key, oauth.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient(sa.ProjectID, sa)
+	c.BaseURL = server.URL
+
+	ctx := context.Background()
+	sub := &webpush.Subscription{Endpoint: "https://fcm.googleapis.com/fcm/send/good"}
+	result, err := c.Send(ctx, sub, "Hello", &webpush.Options{TTL: 60, Urgency: webpush.UrgencyHigh, Topic: "news"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.StatusCode != http.StatusOK || result.ServiceError != nil {
+		t.Errorf("Unexpected result %+v", result)
+	}
+	if result.Name != "projects/test-project/messages/0:1500415314455276%31bd1c9631bd1c96" {
+		t.Errorf("Unexpected message name %v", result.Name)
+	}
+	h := received.Message.Webpush.Headers
+	if h["TTL"] != "60" || h["Urgency"] != "high" || h["Topic"] != "news" {
+		t.Errorf("Unexpected webpush headers %v", h)
+	}
+	if received.Message.Webpush.Data[MessageKey] != "Hello" {
+		t.Errorf("Unexpected webpush data %v", received.Message.Webpush.Data)
+	}
+
+	sub = &webpush.Subscription{Endpoint: "https://fcm.googleapis.com/wp/gone"}
+	result, err = c.Send(ctx, sub, "Hello", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.StatusCode != http.StatusNotFound || result.ServiceError == nil || result.ServiceError.Code != "UNREGISTERED" {
+		t.Errorf("Expected an UNREGISTERED error, got %+v", result)
+	}
+	if issued != 1 {
+		t.Errorf("Expected the access token to be reused, %d were issued", issued)
+	}
+
+	if _, err := c.Send(ctx, sub, "Hello", &webpush.Options{ReceiptURI: "https://example.com/r"}); err == nil {
+		t.Error("Expected an error asking for a receipt")
+	}
+	if _, err := c.Send(ctx, sub, "Hello", &webpush.Options{TTL: -1}); err == nil {
+		t.Error("Expected an error for a negative TTL")
+	}
+}
+
+// newTestClient returns a client that sends to an FCM stub, which records the
+// last request it accepted in received.
+func newTestClient(t *testing.T, received *sendRequest) (*Client, func()) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var issued int
+	oauth := newOAuthStub(t, key, &issued)
+	server := newFCMStub(t, received)
+	sa, err := ServiceAccountFromJSON(testServiceAccountJSON(t, key, oauth.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient(sa.ProjectID, sa)
+	c.BaseURL = server.URL
+	return c, func() {
+		server.Close()
+		oauth.Close()
+	}
+}
+
+func TestSendSigned(t *testing.T) {
+	var received sendRequest
+	c, cleanup := newTestClient(t, &received)
+	defer cleanup()
+
+	key, err := webpush.GenerateVAPIDKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := &webpush.VAPID{PrivateKey: key}
+	sub := &webpush.Subscription{Endpoint: "https://fcm.googleapis.com/fcm/send/good"}
+	if _, err := c.Send(context.Background(), sub, "Hello", &webpush.Options{PayloadSigner: signer}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := webpush.VerifyPayload([]byte(received.Message.Webpush.Data[MessageKey]), sub.Endpoint, signer.PublicKey(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg != "Hello" {
+		t.Errorf("Expected the signed message to be Hello, got %q", msg)
+	}
+}
+
+func TestSendCompressed(t *testing.T) {
+	var received sendRequest
+	c, cleanup := newTestClient(t, &received)
+	defer cleanup()
+
+	sub := &webpush.Subscription{Endpoint: "https://fcm.googleapis.com/fcm/send/good"}
+	if _, err := c.Send(context.Background(), sub, "Hello", &webpush.Options{Compress: true}); err == nil {
+		t.Error("Expected an error asking for compression")
+	}
+	if received.Message.Token != "" {
+		t.Error("Expected nothing to be sent")
+	}
+}
+
+func TestSendEndpointPolicy(t *testing.T) {
+	var received sendRequest
+	c, cleanup := newTestClient(t, &received)
+	defer cleanup()
+
+	sub := &webpush.Subscription{Endpoint: "https://fcm.googleapis.com/fcm/send/good"}
+	opts := &webpush.Options{EndpointPolicy: webpush.AllowHosts("push.example.com")}
+	_, err := c.Send(context.Background(), sub, "Hello", opts)
+	if _, ok := err.(*webpush.EndpointError); !ok {
+		t.Errorf("Expected an *EndpointError, got %v", err)
+	}
+	if received.Message.Token != "" {
+		t.Error("Expected nothing to be sent")
+	}
+}
+
+func TestRegistrationToken(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		token    string
+	}{
+		{"https://fcm.googleapis.com/fcm/send/abc:def", "abc:def"},
+		{"https://fcm.googleapis.com/wp/abc", "abc"},
+		{"https://fcm.googleapis.com/fcm/send/", ""},
+		{"https://updates.push.services.mozilla.com/wpush/v2/abc", ""},
+		{"https://fcm.googleapis.com/other/abc", ""},
+	}
+	for _, test := range tests {
+		token, err := RegistrationToken(test.endpoint)
+		if token != test.token || (test.token == "") != (err != nil) {
+			t.Errorf("%s: expected %q, got %q, %v", test.endpoint, test.token, token, err)
+		}
+	}
+}
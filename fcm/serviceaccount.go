@@ -0,0 +1,243 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fcm
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The OAuth2 scope needed to send messages with the FCM v1 API.
+	messagingScope = "https://www.googleapis.com/auth/firebase.messaging"
+	// The token endpoint of Google's OAuth2 server.
+	defaultTokenURI = "https://oauth2.googleapis.com/token"
+	// How long the signed assertions are valid for.
+	assertionLifetime = time.Hour
+	// How long before they expire that access tokens are replaced.
+	tokenRefreshMargin = time.Minute
+)
+
+// TokenSource returns OAuth2 access tokens for the FCM v1 API.
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// ServiceAccount is a TokenSource that exchanges JWTs signed with a Google
+// service account key for access tokens, as described in
+// https://developers.google.com/identity/protocols/oauth2/service-account.
+// Access tokens are reused until shortly before they expire. A ServiceAccount
+// is safe for concurrent use.
+type ServiceAccount struct {
+	// ProjectID is the Firebase project that the service account belongs to.
+	ProjectID string
+	// ClientEmail identifies the service account.
+	ClientEmail string
+	// PrivateKeyID identifies the key, and is sent as the kid of the JWT.
+	PrivateKeyID string
+	// PrivateKey signs the JWTs.
+	PrivateKey *rsa.PrivateKey
+	// TokenURI is the OAuth2 token endpoint. If empty, Google's is used.
+	TokenURI string
+	// Client is used to fetch access tokens. If nil, http.DefaultClient is
+	// used.
+	Client *http.Client
+	// Now returns the current time. If nil, time.Now is used.
+	Now func() time.Time
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// The JSON key file of a service account, as downloaded from the Google Cloud
+// console.
+type serviceAccountJSON struct {
+	Type         string `json:"type"`
+	ProjectID    string `json:"project_id"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	ClientEmail  string `json:"client_email"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// ServiceAccountFromJSON reads a service account JSON key file.
+func ServiceAccountFromJSON(b []byte) (*ServiceAccount, error) {
+	var sa serviceAccountJSON
+	if err := json.Unmarshal(b, &sa); err != nil {
+		return nil, err
+	}
+	if sa.Type != "service_account" {
+		return nil, fmt.Errorf("fcm: key file is of type %q, not service_account", sa.Type)
+	}
+
+	block, _ := pem.Decode([]byte(sa.PrivateKey))
+	if block == nil {
+		return nil, errors.New("fcm: private_key is not PEM encoded")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		if parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("fcm: invalid private_key: %v", err)
+		}
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("fcm: private_key is not an RSA key")
+	}
+
+	return &ServiceAccount{
+		ProjectID:    sa.ProjectID,
+		ClientEmail:  sa.ClientEmail,
+		PrivateKeyID: sa.PrivateKeyID,
+		PrivateKey:   key,
+		TokenURI:     sa.TokenURI,
+	}, nil
+}
+
+// Token returns an access token, fetching a new one if the last one is about
+// to expire.
+func (s *ServiceAccount) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if s.token != "" && now.Before(s.expires.Add(-tokenRefreshMargin)) {
+		return s.token, nil
+	}
+
+	assertion, err := s.assertion(now)
+	if err != nil {
+		return "", err
+	}
+	token, lifetime, err := s.exchange(ctx, assertion)
+	if err != nil {
+		return "", err
+	}
+	s.token, s.expires = token, now.Add(lifetime)
+	return token, nil
+}
+
+func (s *ServiceAccount) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
+
+func (s *ServiceAccount) tokenURI() string {
+	if s.TokenURI == "" {
+		return defaultTokenURI
+	}
+	return s.TokenURI
+}
+
+// The claims of the JWT exchanged for an access token.
+type assertionClaims struct {
+	Issuer   string `json:"iss"`
+	Scope    string `json:"scope"`
+	Audience string `json:"aud"`
+	IssuedAt int64  `json:"iat"`
+	Expires  int64  `json:"exp"`
+}
+
+// assertion returns a signed JWT asking for an access token.
+func (s *ServiceAccount) assertion(now time.Time) (string, error) {
+	if s.PrivateKey == nil {
+		return "", errors.New("fcm: service account has no private key")
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": s.PrivateKeyID})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(assertionClaims{
+		Issuer:   s.ClientEmail,
+		Scope:    messagingScope,
+		Audience: s.tokenURI(),
+		IssuedAt: now.Unix(),
+		Expires:  now.Add(assertionLifetime).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	b64 := base64.RawURLEncoding
+	unsigned := b64.EncodeToString(header) + "." + b64.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.PrivateKey, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + b64.EncodeToString(sig), nil
+}
+
+// exchange swaps the assertion for an access token and its lifetime.
+func (s *ServiceAccount) exchange(ctx context.Context, assertion string) (string, time.Duration, error) {
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	req, err := http.NewRequest("POST", s.tokenURI(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseLength))
+	if err != nil {
+		return "", 0, err
+	}
+	var token struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil && resp.StatusCode == http.StatusOK {
+		return "", 0, fmt.Errorf("fcm: invalid token response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || token.AccessToken == "" {
+		return "", 0, fmt.Errorf("fcm: token endpoint returned %s: %s %s", resp.Status, token.Error, token.ErrorDescription)
+	}
+	return token.AccessToken, time.Duration(token.ExpiresIn) * time.Second, nil
+}
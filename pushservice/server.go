@@ -0,0 +1,559 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pushservice implements a push service, as described in RFC 8030,
+// for deployments that can't rely on the push services run by browser
+// vendors. It is the counterpart to webpush.NewPushRequest, and the useragent
+// package can receive messages from it.
+//
+//	s := pushservice.NewServer(pushservice.NewMemoryStore())
+//	s.BaseURL = "https://push.example.com"
+//	http.ListenAndServe(":8080", s)
+//
+// The server has these resources, where ids are unguessable random strings
+// that act as capabilities:
+//
+//	POST   /subscribe          create a subscription (user agent)
+//	GET    /subscription/{id}  receive the next message (user agent)
+//	POST   /push/{id}          send a message (application server)
+//	DELETE /m/{id}             acknowledge or cancel a message
+//	POST   /receipts/{id}      create a receipt subscription (application server)
+//	GET    /r/{id}             receive delivery receipts (application server)
+//
+// Go's HTTP client doesn't support HTTP/2 server push, so messages and
+// receipts are delivered to long polling GET requests instead. A message is
+// returned one per response, with its push message resource in the
+// Content-Location header. Receipts are streamed as JSON objects, in the
+// format read by webpush.ReceiptSubscription. Either response is 204 No
+// Content if nothing arrived before LongPollTimeout.
+//
+// Messages are kept until they are acknowledged or their TTL expires. Expired
+// messages are never delivered, but call DeleteExpired periodically to remove
+// them from the Store.
+package pushservice
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/googlechrome/push-encryption-go/webpush"
+)
+
+const (
+	// DefaultMaxTTL is the longest TTL honoured, unless Server.MaxTTL is set.
+	// Longer TTLs are reduced to it, and the TTL header of the response says so.
+	DefaultMaxTTL = 28 * 24 * 60 * 60
+	// DefaultLongPollTimeout is how long GET requests wait for something to
+	// return, unless Server.LongPollTimeout is set.
+	DefaultLongPollTimeout = 30 * time.Second
+	// DefaultRedeliveryTimeout is how long a delivered message waits to be
+	// acknowledged before it is delivered again, unless
+	// Server.RedeliveryTimeout is set.
+	DefaultRedeliveryTimeout = time.Minute
+
+	// A push service is not required to accept more than 4096 bytes.
+	maxMessageLength = 4096
+	// How often long polls check the Store, in case it is shared with other
+	// servers.
+	storePollInterval = time.Second
+)
+
+// Server is an http.Handler implementing a push service.
+type Server struct {
+	Store Store
+	// BaseURL is the URL the server is reachable at, used to build the URLs of
+	// resources. If empty, it is taken from the Host of each request.
+	BaseURL string
+	// MaxTTL is the longest TTL honoured, in seconds. DefaultMaxTTL is used if
+	// it is zero.
+	MaxTTL int
+	// LongPollTimeout and RedeliveryTimeout default to DefaultLongPollTimeout
+	// and DefaultRedeliveryTimeout if zero.
+	LongPollTimeout   time.Duration
+	RedeliveryTimeout time.Duration
+	// Now returns the current time, which VAPID tokens are also checked
+	// against. If nil, time.Now is used.
+	Now func() time.Time
+	// RequireVAPID rejects push requests without a valid VAPID token, as
+	// described in RFC 8292. The aud claim must be the origin of BaseURL, or
+	// of the request if BaseURL is empty.
+	RequireVAPID bool
+
+	mu sync.Mutex
+	// The number of user agents waiting for messages, by subscription.
+	waiting map[string]int
+	// changed is closed and replaced whenever a message or receipt is added.
+	changed chan struct{}
+}
+
+// NewServer returns a Server that keeps its state in store.
+func NewServer(store Store) *Server {
+	return &Server{
+		Store:   store,
+		waiting: make(map[string]int),
+		changed: make(chan struct{}),
+	}
+}
+
+// DeleteExpired removes expired messages from the Store.
+func (s *Server) DeleteExpired(ctx context.Context) (int, error) {
+	return s.Store.DeleteExpired(ctx, s.now())
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	resource, id := parts[0], ""
+	if len(parts) == 2 {
+		id = parts[1]
+	}
+
+	var method string
+	var handler func(http.ResponseWriter, *http.Request, string)
+	switch {
+	case resource == "subscribe" && id == "":
+		method, handler = "POST", s.serveSubscribe
+	case resource == "subscription" && id != "":
+		method, handler = "GET", s.serveSubscription
+	case resource == "push" && id != "":
+		method, handler = "POST", s.servePush
+	case resource == "m" && id != "":
+		method, handler = "DELETE", s.serveMessage
+	case resource == "receipts" && id != "":
+		method, handler = "POST", s.serveReceiptSubscribe
+	case resource == "r" && id != "":
+		method, handler = "GET", s.serveReceipts
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	handler(w, r, id)
+}
+
+func (s *Server) serveSubscribe(w http.ResponseWriter, r *http.Request, _ string) {
+	sub := &Subscription{
+		ID:                 newID(),
+		PushID:             newID(),
+		ReceiptSubscribeID: newID(),
+		Created:            s.now(),
+	}
+	if err := s.Store.AddSubscription(r.Context(), sub); err != nil {
+		storeError(w, err)
+		return
+	}
+
+	w.Header().Add("Link", `<`+s.url(r, "/push/"+sub.PushID)+`>; rel="urn:ietf:params:push"`)
+	w.Header().Add("Link", `<`+s.url(r, "/receipts/"+sub.ReceiptSubscribeID)+`>; rel="urn:ietf:params:push:receipt"`)
+	w.Header().Set("Location", s.url(r, "/subscription/"+sub.ID))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) servePush(w http.ResponseWriter, r *http.Request, pushID string) {
+	ctx := r.Context()
+	sub, err := s.Store.SubscriptionByPushID(ctx, pushID)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	id := sub.ID
+
+	if s.RequireVAPID {
+		if _, err := (&webpush.VAPIDVerifier{Now: s.now}).VerifyHeaders(r.Header, s.origin(r)); err != nil {
+			w.Header().Set("WWW-Authenticate", "vapid")
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+
+	ttl, err := strconv.Atoi(r.Header.Get("TTL"))
+	if err != nil || ttl < 0 {
+		http.Error(w, "missing or invalid TTL header", http.StatusBadRequest)
+		return
+	}
+	if ttl > s.maxTTL() {
+		ttl = s.maxTTL()
+	}
+
+	urgency := webpush.Urgency(r.Header.Get("Urgency"))
+	if urgency == "" {
+		urgency = webpush.UrgencyNormal
+	} else if urgency.Rank() < 0 {
+		http.Error(w, "invalid Urgency header", http.StatusBadRequest)
+		return
+	}
+
+	topic := r.Header.Get("Topic")
+	if topic != "" && !webpush.ValidTopic(topic) {
+		http.Error(w, "invalid Topic header", http.StatusBadRequest)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxMessageLength+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxMessageLength {
+		http.Error(w, "message is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	header := http.Header{}
+	if len(body) > 0 {
+		var encoding webpush.ContentEncoding
+		if err := encoding.UnmarshalText([]byte(r.Header.Get("Content-Encoding"))); err != nil {
+			http.Error(w, "messages must be encrypted with aesgcm or aes128gcm", http.StatusUnsupportedMediaType)
+			return
+		}
+		for _, h := range []string{"Content-Encoding", "Encryption", "Crypto-Key"} {
+			if v := r.Header.Get(h); v != "" {
+				header.Set(h, v)
+			}
+		}
+	}
+
+	var receiptID string
+	if receiptURI := r.Header.Get("Push-Receipt"); receiptURI != "" {
+		receiptID = s.receiptSubscriptionID(r, receiptURI)
+		rs, err := s.Store.ReceiptSubscription(ctx, receiptID)
+		if err != nil || rs.SubscriptionID != id {
+			http.Error(w, "unknown receipt subscription", http.StatusBadRequest)
+			return
+		}
+	}
+
+	now := s.now()
+	m := &Message{
+		ID:                    newID(),
+		SubscriptionID:        id,
+		Header:                header,
+		Body:                  body,
+		Urgency:               urgency,
+		Topic:                 topic,
+		ReceiptSubscriptionID: receiptID,
+		Created:               now,
+		Expires:               now.Add(time.Duration(ttl) * time.Second),
+	}
+
+	w.Header().Set("Location", s.url(r, "/m/"+m.ID))
+	w.Header().Set("TTL", strconv.Itoa(ttl))
+
+	// A message with a TTL of zero is only delivered to a user agent that is
+	// already waiting for it, otherwise it is dropped straight away.
+	if ttl == 0 {
+		if !s.isWaiting(id) {
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		m.Expires = now.Add(time.Second)
+	}
+
+	if err := s.Store.AddMessage(ctx, m); err != nil {
+		w.Header().Del("Location")
+		storeError(w, err)
+		return
+	}
+	s.notify()
+	w.WriteHeader(http.StatusCreated)
+}
+
+// serveSubscription long polls for the next message. A user agent can ask for
+// only messages of at least some urgency with the Urgency header.
+func (s *Server) serveSubscription(w http.ResponseWriter, r *http.Request, id string) {
+	ctx := r.Context()
+	if _, err := s.Store.Subscription(ctx, id); err != nil {
+		storeError(w, err)
+		return
+	}
+	minUrgency := webpush.Urgency(r.Header.Get("Urgency")).Rank()
+
+	s.mu.Lock()
+	s.waiting[id]++
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		if s.waiting[id]--; s.waiting[id] == 0 {
+			delete(s.waiting, id)
+		}
+		s.mu.Unlock()
+	}()
+
+	s.longPoll(w, r, func(w http.ResponseWriter) (bool, error) {
+		now := s.now()
+		pending, err := s.Store.PendingMessages(ctx, id, now, now.Add(-s.redeliveryTimeout()))
+		if err != nil {
+			return false, err
+		}
+		for _, m := range pending {
+			if m.Urgency.Rank() < minUrgency {
+				continue
+			}
+			if err := s.Store.MarkDelivered(ctx, m.ID, now); err != nil {
+				return false, err
+			}
+			for h := range m.Header {
+				w.Header().Set(h, m.Header.Get(h))
+			}
+			if m.Topic != "" {
+				w.Header().Set("Topic", m.Topic)
+			}
+			w.Header().Set("Urgency", string(m.Urgency))
+			w.Header().Set("Content-Location", s.url(r, "/m/"+m.ID))
+			w.WriteHeader(http.StatusOK)
+			w.Write(m.Body)
+			return true, nil
+		}
+		return false, nil
+	})
+}
+
+// serveMessage deletes a message. If it was delivered this acknowledges it,
+// which sends a receipt if one was requested, otherwise it is cancelled.
+func (s *Server) serveMessage(w http.ResponseWriter, r *http.Request, id string) {
+	ctx := r.Context()
+	m, err := s.Store.Message(ctx, id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if err := s.Store.DeleteMessage(ctx, id); err != nil {
+		storeError(w, err)
+		return
+	}
+
+	if !m.Delivered.IsZero() && m.ReceiptSubscriptionID != "" {
+		receipt := &webpush.Receipt{Message: s.url(r, "/m/"+m.ID)}
+		if err := s.Store.AddReceipt(ctx, m.ReceiptSubscriptionID, receipt); err != nil && err != ErrNotFound {
+			storeError(w, err)
+			return
+		}
+		s.notify()
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) serveReceiptSubscribe(w http.ResponseWriter, r *http.Request, receiptSubscribeID string) {
+	ctx := r.Context()
+	sub, err := s.Store.SubscriptionByReceiptSubscribeID(ctx, receiptSubscribeID)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+
+	rs := &ReceiptSubscription{ID: newID(), SubscriptionID: sub.ID, Created: s.now()}
+	if err := s.Store.AddReceiptSubscription(ctx, rs); err != nil {
+		storeError(w, err)
+		return
+	}
+	w.Header().Set("Location", s.url(r, "/r/"+rs.ID))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// serveReceipts long polls for receipts, and streams them as they arrive
+// until the timeout once there is at least one.
+func (s *Server) serveReceipts(w http.ResponseWriter, r *http.Request, id string) {
+	ctx := r.Context()
+	if _, err := s.Store.ReceiptSubscription(ctx, id); err != nil {
+		storeError(w, err)
+		return
+	}
+
+	started := false
+	s.longPoll(w, r, func(w http.ResponseWriter) (bool, error) {
+		receipts, err := s.Store.TakeReceipts(ctx, id)
+		if err != nil || len(receipts) == 0 {
+			return false, err
+		}
+		if !started {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+		enc := json.NewEncoder(w)
+		for _, receipt := range receipts {
+			enc.Encode(receipt)
+		}
+		w.(http.Flusher).Flush()
+		return false, nil
+	})
+}
+
+// longPoll calls check until it reports that it has finished the response,
+// or the request times out. If nothing was written by then the response is
+// 204 No Content.
+func (s *Server) longPoll(w http.ResponseWriter, r *http.Request, check func(http.ResponseWriter) (bool, error)) {
+	timeout := s.LongPollTimeout
+	if timeout == 0 {
+		timeout = DefaultLongPollTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	ticker := time.NewTicker(storePollInterval)
+	defer ticker.Stop()
+
+	tw := &trackingWriter{ResponseWriter: w}
+	for {
+		s.mu.Lock()
+		changed := s.changed
+		s.mu.Unlock()
+
+		done, err := check(tw)
+		if err != nil {
+			if !tw.started {
+				storeError(w, err)
+			}
+			return
+		}
+		if done {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-ticker.C:
+		case <-timer.C:
+			if !tw.started {
+				w.WriteHeader(http.StatusNoContent)
+			}
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// notify wakes up long polls to check the Store again.
+func (s *Server) notify() {
+	s.mu.Lock()
+	close(s.changed)
+	s.changed = make(chan struct{})
+	s.mu.Unlock()
+}
+
+func (s *Server) isWaiting(subscriptionID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.waiting[subscriptionID] > 0
+}
+
+func (s *Server) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
+
+func (s *Server) maxTTL() int {
+	if s.MaxTTL == 0 {
+		return DefaultMaxTTL
+	}
+	return s.MaxTTL
+}
+
+func (s *Server) redeliveryTimeout() time.Duration {
+	if s.RedeliveryTimeout == 0 {
+		return DefaultRedeliveryTimeout
+	}
+	return s.RedeliveryTimeout
+}
+
+// url returns the absolute URL of a resource on the server.
+func (s *Server) url(r *http.Request, path string) string {
+	if s.BaseURL != "" {
+		return strings.TrimSuffix(s.BaseURL, "/") + path
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + path
+}
+
+// origin returns the scheme and host of the server, the audience of VAPID
+// tokens.
+func (s *Server) origin(r *http.Request) string {
+	u, err := url.Parse(s.url(r, "/"))
+	if err != nil {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// receiptSubscriptionID returns the id of the receipt subscription at uri, or
+// "" if it isn't one of ours.
+func (s *Server) receiptSubscriptionID(r *http.Request, uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return ""
+	}
+	prefix, err := url.Parse(s.url(r, "/r/"))
+	if err != nil || u.Host != prefix.Host || !strings.HasPrefix(u.Path, prefix.Path) {
+		return ""
+	}
+	return strings.TrimPrefix(u.Path, prefix.Path)
+}
+
+// trackingWriter records whether a response has been started.
+type trackingWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (w *trackingWriter) WriteHeader(code int) {
+	w.started = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *trackingWriter) Write(b []byte) (int, error) {
+	w.started = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *trackingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func storeError(w http.ResponseWriter, err error) {
+	if err == ErrNotFound {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,396 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushservice
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/googlechrome/push-encryption-go/useragent"
+	"github.com/googlechrome/push-encryption-go/webpush"
+)
+
+// testClock is a clock for Server.Now that only moves when told to.
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newTestServer(t *testing.T) (*Server, *httptest.Server, *testClock) {
+	clock := &testClock{now: time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s := NewServer(NewMemoryStore())
+	s.LongPollTimeout = 50 * time.Millisecond
+	s.Now = clock.Now
+	return s, httptest.NewServer(s), clock
+}
+
+// receive waits for a message, returning nil if there is none.
+func receive(t *testing.T, ua *useragent.Subscription) *useragent.Message {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	m, err := ua.Receive(ctx)
+	if err != nil && ctx.Err() == nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestEndToEnd(t *testing.T) {
+	_, ts, _ := newTestServer(t)
+	defer ts.Close()
+	ctx := context.Background()
+
+	ua, err := useragent.Subscribe(ctx, nil, ts.URL+"/subscribe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := webpush.NewReceiptSubscription(ctx, nil, ua.ReceiptSubscribe)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := webpush.SendWithOptions(nil, ua.Subscription, "I am the walrus", &webpush.Options{
+		TTL:        60,
+		Urgency:    webpush.UrgencyHigh,
+		ReceiptURI: rs.URI,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected 201 Created, got %d %s", result.StatusCode, result.Body)
+	}
+	if result.Header.Get("TTL") != "60" {
+		t.Errorf("Expected TTL header to be 60, got %v", result.Header.Get("TTL"))
+	}
+
+	m := receive(t, ua)
+	if m == nil {
+		t.Fatal("Expected a message")
+	}
+	if string(m.Data) != "I am the walrus" || m.Urgency != "high" || m.URI != result.Location {
+		t.Errorf("Unexpected message %+v", m)
+	}
+	if err := m.Acknowledge(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	receipts := make(chan *webpush.Receipt, 1)
+	lctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	go rs.Listen(lctx, func(r *webpush.Receipt) { receipts <- r })
+	select {
+	case r := <-receipts:
+		if r.Message != result.Location {
+			t.Errorf("Receipt was for %v, expected %v", r.Message, result.Location)
+		}
+	case <-lctx.Done():
+		t.Fatal("Timed out waiting for a receipt")
+	}
+
+	// Acknowledged messages are gone.
+	if err := result.Message.Cancel(ctx); err != webpush.ErrMessageGone {
+		t.Errorf("Expected ErrMessageGone, got %v", err)
+	}
+	if m := receive(t, ua); m != nil {
+		t.Errorf("Expected no more messages, got %+v", m)
+	}
+}
+
+func TestResourceIDsAreSeparate(t *testing.T) {
+	_, ts, _ := newTestServer(t)
+	defer ts.Close()
+
+	ua, err := useragent.Subscribe(context.Background(), nil, ts.URL+"/subscribe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := func(resource string) string {
+		return resource[strings.LastIndex(resource, "/")+1:]
+	}
+	pushID, subID, receiptID := id(ua.Subscription.Endpoint), id(ua.Resource), id(ua.ReceiptSubscribe)
+	if pushID == subID || pushID == receiptID || subID == receiptID {
+		t.Fatalf("Expected separate ids, got push %s, subscription %s and receipts %s", pushID, subID, receiptID)
+	}
+
+	// Knowing the endpoint must not give access to the subscription resource.
+	tests := []struct{ method, path string }{
+		{"GET", "/subscription/" + pushID},
+		{"GET", "/subscription/" + receiptID},
+		{"POST", "/push/" + subID},
+		{"POST", "/receipts/" + pushID},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, ts.URL+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("TTL", "0")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s %s: expected 404, got %d", test.method, test.path, resp.StatusCode)
+		}
+	}
+}
+
+func TestTopicReplacement(t *testing.T) {
+	_, ts, _ := newTestServer(t)
+	defer ts.Close()
+
+	ua, err := useragent.Subscribe(context.Background(), nil, ts.URL+"/subscribe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, message := range []string{"first", "second"} {
+		if _, err := webpush.SendWithOptions(nil, ua.Subscription, message, &webpush.Options{TTL: 60, Topic: "score"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := receive(t, ua)
+	if m == nil || string(m.Data) != "second" {
+		t.Fatalf("Expected the second message to replace the first, got %+v", m)
+	}
+	if m := receive(t, ua); m != nil {
+		t.Errorf("Expected the first message to be gone, got %q", m.Data)
+	}
+}
+
+func TestExpiryAndRedelivery(t *testing.T) {
+	s, ts, clock := newTestServer(t)
+	defer ts.Close()
+	ctx := context.Background()
+
+	ua, err := useragent.Subscribe(ctx, nil, ts.URL+"/subscribe")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nobody is waiting for a message with a TTL of zero.
+	result, err := webpush.SendWithOptions(nil, ua.Subscription, "now or never", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected 201 Created, got %d", result.StatusCode)
+	}
+	if err := result.Message.Cancel(ctx); err != webpush.ErrMessageGone {
+		t.Errorf("Expected the message to have been dropped, got %v", err)
+	}
+
+	if _, err := webpush.SendWithOptions(nil, ua.Subscription, "short lived", &webpush.Options{TTL: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := webpush.SendWithOptions(nil, ua.Subscription, "long lived", &webpush.Options{TTL: 100}); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(11 * time.Second)
+	if n, err := s.DeleteExpired(ctx); err != nil || n != 1 {
+		t.Errorf("Expected one expired message, got %d, %v", n, err)
+	}
+
+	m := receive(t, ua)
+	if m == nil || string(m.Data) != "long lived" {
+		t.Fatalf("Expected the long lived message, got %+v", m)
+	}
+	// Without an acknowledgement it is delivered again later.
+	if m := receive(t, ua); m != nil {
+		t.Fatalf("Expected no message before the redelivery timeout, got %+v", m)
+	}
+	clock.Advance(DefaultRedeliveryTimeout)
+	if m := receive(t, ua); m == nil || string(m.Data) != "long lived" {
+		t.Fatalf("Expected the message to be redelivered, got %+v", m)
+	}
+}
+
+func TestUrgencyFilter(t *testing.T) {
+	_, ts, _ := newTestServer(t)
+	defer ts.Close()
+
+	ua, err := useragent.Subscribe(context.Background(), nil, ts.URL+"/subscribe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := webpush.SendWithOptions(nil, ua.Subscription, "", &webpush.Options{TTL: 60, Urgency: webpush.UrgencyLow}); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", ua.Resource, nil)
+	req.Header.Set("Urgency", "normal")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected the low urgency message to be held back, got %d", resp.StatusCode)
+	}
+
+	if m := receive(t, ua); m == nil {
+		t.Error("Expected the message without an urgency filter")
+	}
+}
+
+func TestPushValidation(t *testing.T) {
+	s, ts, _ := newTestServer(t)
+	defer ts.Close()
+	ctx := context.Background()
+
+	ua, err := useragent.Subscribe(ctx, nil, ts.URL+"/subscribe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := useragent.Subscribe(ctx, nil, ts.URL+"/subscribe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherReceipts, err := webpush.NewReceiptSubscription(ctx, nil, other.ReceiptSubscribe)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		endpoint string
+		header   map[string]string
+		body     string
+		status   int
+	}{
+		{"unknown subscription", ts.URL + "/push/nope", map[string]string{"TTL": "0"}, "", http.StatusNotFound},
+		{"missing TTL", ua.Subscription.Endpoint, nil, "", http.StatusBadRequest},
+		{"invalid urgency", ua.Subscription.Endpoint, map[string]string{"TTL": "0", "Urgency": "now"}, "", http.StatusBadRequest},
+		{"invalid topic", ua.Subscription.Endpoint, map[string]string{"TTL": "0", "Topic": "a b"}, "", http.StatusBadRequest},
+		{"unencrypted", ua.Subscription.Endpoint, map[string]string{"TTL": "0"}, "hello", http.StatusUnsupportedMediaType},
+		{"too large", ua.Subscription.Endpoint, map[string]string{"TTL": "0", "Content-Encoding": "aes128gcm"}, strings.Repeat("a", 4097), http.StatusRequestEntityTooLarge},
+		{"other receipt subscription", ua.Subscription.Endpoint, map[string]string{"TTL": "0", "Push-Receipt": otherReceipts.URI}, "", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("POST", test.endpoint, bytes.NewReader([]byte(test.body)))
+		for k, v := range test.header {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: expected %d, got %d", test.name, test.status, resp.StatusCode)
+		}
+	}
+
+	s.MaxTTL = 30
+	result, err := webpush.SendWithOptions(nil, ua.Subscription, "", &webpush.Options{TTL: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Header.Get("TTL") != "30" {
+		t.Errorf("Expected the TTL to be reduced to 30, got %v", result.Header.Get("TTL"))
+	}
+
+	resp, err := http.Get(ua.Subscription.Endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for GET on a push resource, got %d", resp.StatusCode)
+	}
+}
+
+func TestCancelBeforeDelivery(t *testing.T) {
+	_, ts, _ := newTestServer(t)
+	defer ts.Close()
+	ctx := context.Background()
+
+	ua, err := useragent.Subscribe(ctx, nil, ts.URL+"/subscribe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := webpush.SendWithOptions(nil, ua.Subscription, "oops", &webpush.Options{TTL: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := result.Message.Cancel(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if m := receive(t, ua); m != nil {
+		t.Errorf("Expected the cancelled message not to be delivered, got %+v", m)
+	}
+}
+
+func TestRequireVAPID(t *testing.T) {
+	s, ts, clock := newTestServer(t)
+	defer ts.Close()
+	s.RequireVAPID = true
+
+	ua, err := useragent.Subscribe(context.Background(), nil, ts.URL+"/subscribe")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := webpush.SendWithOptions(nil, ua.Subscription, "", &webpush.Options{TTL: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without VAPID, got %d", result.StatusCode)
+	}
+
+	key, err := webpush.GenerateVAPIDKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vapid := &webpush.VAPID{PrivateKey: key, Subject: "mailto:push@example.com", Now: clock.Now}
+	result, err = webpush.SendWithOptions(nil, ua.Subscription, "", &webpush.Options{TTL: 60, VAPID: vapid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.StatusCode != http.StatusCreated {
+		t.Errorf("Expected 201 with VAPID, got %d %s", result.StatusCode, result.Body)
+	}
+
+	// Tokens are for the origin in BaseURL when it is set.
+	s.BaseURL = "https://push.example.com/service"
+	result, err = webpush.SendWithOptions(nil, ua.Subscription, "", &webpush.Options{TTL: 60, VAPID: vapid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a token for the wrong origin, got %d", result.StatusCode)
+	}
+}
@@ -0,0 +1,316 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushservice
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/googlechrome/push-encryption-go/webpush"
+)
+
+// ErrNotFound is returned by a Store when there is nothing with the given id.
+var ErrNotFound = errors.New("pushservice: not found")
+
+// Subscription is a push subscription created by a user agent. Each of its
+// resources has its own random id, so that knowing the push resource, which is
+// given to application servers, doesn't give access to the others.
+type Subscription struct {
+	// ID identifies the subscription resource, which only the user agent
+	// knows. Messages refer to the subscription by this id.
+	ID string
+	// PushID identifies the push resource that application servers send to.
+	PushID string
+	// ReceiptSubscribeID identifies the receipt subscribe resource.
+	ReceiptSubscribeID string
+	Created            time.Time
+}
+
+// Message is a push message waiting to be delivered or acknowledged.
+type Message struct {
+	ID             string
+	SubscriptionID string
+	// Header holds the Content-Encoding, Encryption and Crypto-Key headers the
+	// user agent needs to decrypt the body.
+	Header  http.Header
+	Body    []byte
+	Urgency webpush.Urgency
+	Topic   string
+	// ReceiptSubscriptionID is set if the application server asked for a
+	// delivery receipt.
+	ReceiptSubscriptionID string
+	Created               time.Time
+	Expires               time.Time
+	// Delivered is when the message was last sent to the user agent, or zero
+	// if it hasn't been.
+	Delivered time.Time
+}
+
+// ReceiptSubscription is a subscription to delivery receipts created by an
+// application server.
+type ReceiptSubscription struct {
+	ID string
+	// SubscriptionID is the push subscription whose messages can request
+	// receipts from this receipt subscription.
+	SubscriptionID string
+	Created        time.Time
+}
+
+// Store persists the state of a push service. Implementations must be safe
+// for concurrent use. Methods return ErrNotFound for unknown ids.
+type Store interface {
+	AddSubscription(ctx context.Context, s *Subscription) error
+	Subscription(ctx context.Context, id string) (*Subscription, error)
+	// SubscriptionByPushID returns the subscription with a PushID.
+	SubscriptionByPushID(ctx context.Context, pushID string) (*Subscription, error)
+	// SubscriptionByReceiptSubscribeID returns the subscription with a
+	// ReceiptSubscribeID.
+	SubscriptionByReceiptSubscribeID(ctx context.Context, receiptSubscribeID string) (*Subscription, error)
+
+	// AddMessage stores a message. If it has a Topic, any message for the same
+	// subscription with the same topic that hasn't been delivered is removed,
+	// as the new message replaces it.
+	AddMessage(ctx context.Context, m *Message) error
+	Message(ctx context.Context, id string) (*Message, error)
+	// PendingMessages returns the messages for a subscription that haven't
+	// expired at now and haven't been delivered since redeliverBefore, oldest
+	// first.
+	PendingMessages(ctx context.Context, subscriptionID string, now, redeliverBefore time.Time) ([]*Message, error)
+	// MarkDelivered records that a message was sent to the user agent.
+	MarkDelivered(ctx context.Context, id string, at time.Time) error
+	DeleteMessage(ctx context.Context, id string) error
+	// DeleteExpired removes messages that expired before now, and returns how
+	// many there were.
+	DeleteExpired(ctx context.Context, now time.Time) (int, error)
+
+	AddReceiptSubscription(ctx context.Context, r *ReceiptSubscription) error
+	ReceiptSubscription(ctx context.Context, id string) (*ReceiptSubscription, error)
+	// AddReceipt queues a receipt for a receipt subscription.
+	AddReceipt(ctx context.Context, receiptSubscriptionID string, r *webpush.Receipt) error
+	// TakeReceipts removes and returns the queued receipts for a receipt
+	// subscription.
+	TakeReceipts(ctx context.Context, receiptSubscriptionID string) ([]*webpush.Receipt, error)
+}
+
+// MemoryStore is a Store that keeps everything in memory.
+type MemoryStore struct {
+	mu            sync.Mutex
+	subscriptions map[string]*Subscription
+	pushIDs       map[string]string
+	receiptSubIDs map[string]string
+	messages      map[string]*Message
+	receiptSubs   map[string]*ReceiptSubscription
+	receipts      map[string][]*webpush.Receipt
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		subscriptions: make(map[string]*Subscription),
+		pushIDs:       make(map[string]string),
+		receiptSubIDs: make(map[string]string),
+		messages:      make(map[string]*Message),
+		receiptSubs:   make(map[string]*ReceiptSubscription),
+		receipts:      make(map[string][]*webpush.Receipt),
+	}
+}
+
+// AddSubscription implements Store.
+func (s *MemoryStore) AddSubscription(ctx context.Context, sub *Subscription) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := *sub
+	s.subscriptions[sub.ID] = &c
+	s.pushIDs[sub.PushID] = sub.ID
+	s.receiptSubIDs[sub.ReceiptSubscribeID] = sub.ID
+	return nil
+}
+
+// Subscription implements Store.
+func (s *MemoryStore) Subscription(ctx context.Context, id string) (*Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.subscription(id)
+}
+
+// SubscriptionByPushID implements Store.
+func (s *MemoryStore) SubscriptionByPushID(ctx context.Context, pushID string) (*Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, ok := s.pushIDs[pushID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return s.subscription(id)
+}
+
+// SubscriptionByReceiptSubscribeID implements Store.
+func (s *MemoryStore) SubscriptionByReceiptSubscribeID(ctx context.Context, receiptSubscribeID string) (*Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, ok := s.receiptSubIDs[receiptSubscribeID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return s.subscription(id)
+}
+
+// subscription returns a copy of a subscription. s.mu must be held.
+func (s *MemoryStore) subscription(id string) (*Subscription, error) {
+	sub, ok := s.subscriptions[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *sub
+	return &c, nil
+}
+
+// AddMessage implements Store.
+func (s *MemoryStore) AddMessage(ctx context.Context, m *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m.Topic != "" {
+		for id, old := range s.messages {
+			if old.SubscriptionID == m.SubscriptionID && old.Topic == m.Topic && old.Delivered.IsZero() {
+				delete(s.messages, id)
+			}
+		}
+	}
+	c := *m
+	s.messages[m.ID] = &c
+	return nil
+}
+
+// Message implements Store.
+func (s *MemoryStore) Message(ctx context.Context, id string) (*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.messages[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *m
+	return &c, nil
+}
+
+// PendingMessages implements Store.
+func (s *MemoryStore) PendingMessages(ctx context.Context, subscriptionID string, now, redeliverBefore time.Time) ([]*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var pending []*Message
+	for _, m := range s.messages {
+		if m.SubscriptionID != subscriptionID || !now.Before(m.Expires) {
+			continue
+		}
+		if !m.Delivered.IsZero() && m.Delivered.After(redeliverBefore) {
+			continue
+		}
+		c := *m
+		pending = append(pending, &c)
+	}
+	sort.Sort(byCreated(pending))
+	return pending, nil
+}
+
+// MarkDelivered implements Store.
+func (s *MemoryStore) MarkDelivered(ctx context.Context, id string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.messages[id]
+	if !ok {
+		return ErrNotFound
+	}
+	m.Delivered = at
+	return nil
+}
+
+// DeleteMessage implements Store.
+func (s *MemoryStore) DeleteMessage(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.messages[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.messages, id)
+	return nil
+}
+
+// DeleteExpired implements Store.
+func (s *MemoryStore) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for id, m := range s.messages {
+		if !now.Before(m.Expires) {
+			delete(s.messages, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// AddReceiptSubscription implements Store.
+func (s *MemoryStore) AddReceiptSubscription(ctx context.Context, r *ReceiptSubscription) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := *r
+	s.receiptSubs[r.ID] = &c
+	return nil
+}
+
+// ReceiptSubscription implements Store.
+func (s *MemoryStore) ReceiptSubscription(ctx context.Context, id string) (*ReceiptSubscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.receiptSubs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *r
+	return &c, nil
+}
+
+// AddReceipt implements Store.
+func (s *MemoryStore) AddReceipt(ctx context.Context, receiptSubscriptionID string, r *webpush.Receipt) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.receiptSubs[receiptSubscriptionID]; !ok {
+		return ErrNotFound
+	}
+	s.receipts[receiptSubscriptionID] = append(s.receipts[receiptSubscriptionID], r)
+	return nil
+}
+
+// TakeReceipts implements Store.
+func (s *MemoryStore) TakeReceipts(ctx context.Context, receiptSubscriptionID string) ([]*webpush.Receipt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.receiptSubs[receiptSubscriptionID]; !ok {
+		return nil, ErrNotFound
+	}
+	receipts := s.receipts[receiptSubscriptionID]
+	delete(s.receipts, receiptSubscriptionID)
+	return receipts, nil
+}
+
+type byCreated []*Message
+
+func (b byCreated) Len() int           { return len(b) }
+func (b byCreated) Less(i, j int) bool { return b[i].Created.Before(b[j].Created) }
+func (b byCreated) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
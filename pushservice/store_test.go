@@ -0,0 +1,89 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushservice
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/googlechrome/push-encryption-go/webpush"
+)
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	if _, err := s.Subscription(ctx, "sub"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	add := func(id, topic string, created time.Duration) {
+		m := &Message{ID: id, SubscriptionID: "sub", Topic: topic, Created: now.Add(created), Expires: now.Add(time.Hour)}
+		if err := s.AddMessage(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pending := func() []string {
+		messages, err := s.PendingMessages(ctx, "sub", now, now.Add(-time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, m := range messages {
+			ids = append(ids, m.ID)
+		}
+		return ids
+	}
+
+	add("b", "", 2)
+	add("a", "t", 1)
+	if ids := pending(); len(ids) != 2 || ids[0] != "a" || ids[1] != "b" {
+		t.Errorf("Expected messages oldest first, got %v", ids)
+	}
+
+	// A delivered message with the topic isn't replaced.
+	if err := s.MarkDelivered(ctx, "a", now); err != nil {
+		t.Fatal(err)
+	}
+	add("c", "t", 3)
+	if _, err := s.Message(ctx, "a"); err != nil {
+		t.Errorf("Expected the delivered message to remain, got %v", err)
+	}
+	add("d", "t", 4)
+	if _, err := s.Message(ctx, "c"); err != ErrNotFound {
+		t.Errorf("Expected the undelivered message to be replaced, got %v", err)
+	}
+	if ids := pending(); len(ids) != 2 || ids[0] != "b" || ids[1] != "d" {
+		t.Errorf("Expected b and d to be pending, got %v", ids)
+	}
+
+	if n, _ := s.DeleteExpired(ctx, now.Add(time.Hour)); n != 3 {
+		t.Errorf("Expected 3 expired messages, got %d", n)
+	}
+
+	if err := s.AddReceipt(ctx, "r", &webpush.Receipt{}); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for an unknown receipt subscription, got %v", err)
+	}
+	s.AddReceiptSubscription(ctx, &ReceiptSubscription{ID: "r"})
+	s.AddReceipt(ctx, "r", &webpush.Receipt{Message: "m"})
+	if receipts, _ := s.TakeReceipts(ctx, "r"); len(receipts) != 1 {
+		t.Errorf("Expected one receipt, got %v", receipts)
+	}
+	if receipts, _ := s.TakeReceipts(ctx, "r"); len(receipts) != 0 {
+		t.Errorf("Expected receipts to be taken, got %v", receipts)
+	}
+}
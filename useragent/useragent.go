@@ -0,0 +1,265 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package useragent implements the user agent side of the Web Push protocol
+// described in RFC 8030, so that a Go program can receive push messages the
+// way a browser does.
+//
+//	s, err := useragent.Subscribe(ctx, nil, subscribeURI)
+//	// Give s.Subscription to the application server, for example as JSON.
+//
+//	for {
+//	  m, err := s.Receive(ctx)
+//	  ...
+//	  m.Acknowledge(ctx)
+//	}
+//
+// RFC 8030 delivers messages using HTTP/2 server push, which Go's HTTP client
+// doesn't support. Instead the subscription resource is polled with GET
+// requests, to which the push service replies with 204 No Content if no
+// message arrived before it timed out, or with a single message whose push
+// message resource is in the Content-Location header.
+package useragent
+
+import (
+	"context"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/googlechrome/push-encryption-go/webpush"
+)
+
+const (
+	// Link relation types from section 9.2 of RFC 8030.
+	relPush    = "urn:ietf:params:push"
+	relReceipt = "urn:ietf:params:push:receipt"
+
+	// Push services are not required to accept more than 4096 bytes, so this
+	// leaves plenty of room.
+	maxMessageLength = 64 << 10
+)
+
+// Subscription is a push subscription held by the user agent, along with the
+// private key needed to decrypt its messages. It can be marshaled to JSON to
+// keep it across restarts.
+type Subscription struct {
+	// Subscription is what an application server needs to send messages to
+	// this user agent, in the same form as a browser's PushSubscription.
+	Subscription *webpush.Subscription
+	// PrivateKey is the private key matching Subscription.Key.
+	PrivateKey []byte
+	// Resource is the push subscription resource that messages are read from.
+	Resource string
+	// ReceiptSubscribe is the receipt subscribe resource, which application
+	// servers need to request delivery receipts. It is empty if the push
+	// service doesn't support receipts.
+	ReceiptSubscribe string
+	// Client is used to talk to the push service. If nil, http.DefaultClient
+	// is used.
+	Client *http.Client `json:"-"`
+}
+
+// Message is a push message received by the user agent.
+type Message struct {
+	// URI is the push message resource.
+	URI string
+	// Topic and Urgency are the values of the headers the application server
+	// sent, if any.
+	Topic   string
+	Urgency string
+	// Data is the decrypted payload, which is empty if the message had none.
+	Data []byte
+
+	client *http.Client
+}
+
+// Subscribe creates a subscription by POSTing to the subscribe resource of a
+// push service, and generates the keys that application servers use to
+// encrypt messages for it.
+func Subscribe(ctx context.Context, client *http.Client, subscribeURI string) (*Subscription, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	priv, x, y, err := elliptic.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	auth := make([]byte, 16)
+	if _, err := rand.Read(auth); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", subscribeURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("subscribe resource returned %s", resp.Status)
+	}
+	loc, err := resp.Location()
+	if err != nil {
+		return nil, fmt.Errorf("subscribe resource returned no subscription resource: %v", err)
+	}
+	links := parseLinks(resp.Request.URL, resp.Header["Link"])
+	if links[relPush] == "" {
+		return nil, errors.New("subscribe resource returned no push resource")
+	}
+
+	return &Subscription{
+		Subscription: &webpush.Subscription{
+			Endpoint: links[relPush],
+			Key:      elliptic.Marshal(elliptic.P256(), x, y),
+			Auth:     auth,
+		},
+		PrivateKey:       priv,
+		Resource:         loc.String(),
+		ReceiptSubscribe: links[relReceipt],
+		Client:           client,
+	}, nil
+}
+
+// Receive waits for the next message and decrypts it. If decryption fails the
+// message is returned along with the error, so that it can be acknowledged to
+// discard it.
+func (s *Subscription) Receive(ctx context.Context) (*Message, error) {
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	for {
+		req, err := http.NewRequest("GET", s.Resource, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+			return s.readMessage(client, resp)
+		case http.StatusNoContent:
+			resp.Body.Close()
+		default:
+			resp.Body.Close()
+			return nil, fmt.Errorf("subscription resource returned %s", resp.Status)
+		}
+	}
+}
+
+func (s *Subscription) readMessage(client *http.Client, resp *http.Response) (*Message, error) {
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxMessageLength))
+	if err != nil {
+		return nil, err
+	}
+	uri := resp.Header.Get("Content-Location")
+	if uri == "" {
+		return nil, errors.New("message has no push message resource")
+	}
+	if u, err := resp.Request.URL.Parse(uri); err == nil {
+		uri = u.String()
+	}
+
+	m := &Message{
+		URI:     uri,
+		Topic:   resp.Header.Get("Topic"),
+		Urgency: resp.Header.Get("Urgency"),
+		client:  client,
+	}
+	if len(body) == 0 {
+		return m, nil
+	}
+
+	result, err := webpush.ParseEncryptionResult(resp.Header, body)
+	if err != nil {
+		return m, err
+	}
+	if m.Data, err = webpush.Decrypt(s.Subscription, s.PrivateKey, result); err != nil {
+		return m, fmt.Errorf("couldn't decrypt message: %v", err)
+	}
+	return m, nil
+}
+
+// Acknowledge tells the push service that the message was received, by
+// deleting its push message resource as described in section 6.2 of RFC 8030.
+// The push service then sends a receipt if the application server asked for
+// one.
+func (m *Message) Acknowledge(ctx context.Context) error {
+	client := m.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequest("DELETE", m.URI, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("push service returned %s when acknowledging the message", resp.Status)
+	}
+	return nil
+}
+
+// parseLinks returns the target of each relation type in Link headers like
+// `<https://push.example.net/push/JzLQ3raZJfFBR0aqvOMsLrt54w4rJUsV>;
+// rel="urn:ietf:params:push"`, resolved against base.
+func parseLinks(base *url.URL, headers []string) map[string]string {
+	links := make(map[string]string)
+	for _, header := range headers {
+		for _, link := range strings.Split(header, ",") {
+			parts := strings.Split(link, ";")
+			target := strings.TrimSpace(parts[0])
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			u, err := base.Parse(target[1 : len(target)-1])
+			if err != nil {
+				continue
+			}
+			for _, param := range parts[1:] {
+				kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "rel") {
+					for _, rel := range strings.Fields(strings.Trim(kv[1], `"`)) {
+						links[rel] = u.String()
+					}
+				}
+			}
+		}
+	}
+	return links
+}
@@ -0,0 +1,149 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package useragent
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/googlechrome/push-encryption-go/webpush"
+	"github.com/googlechrome/push-encryption-go/webpush/webpushtest"
+)
+
+func TestSubscribeAndReceive(t *testing.T) {
+	s := webpushtest.NewServer()
+	defer s.Close()
+	s.LongPollTimeout = 50 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ua, err := Subscribe(ctx, nil, s.SubscribeURI())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ua.ReceiptSubscribe != s.ReceiptSubscribeURI() {
+		t.Errorf("Receipt subscribe resource was %v, expected %v", ua.ReceiptSubscribe, s.ReceiptSubscribeURI())
+	}
+
+	// The application server only sees the JSON form of the subscription.
+	b, err := json.Marshal(ua.Subscription)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := webpush.SubscriptionFromJSON(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs, err := webpush.NewReceiptSubscription(ctx, nil, ua.ReceiptSubscribe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receipts := make(chan *webpush.Receipt, 1)
+	go rs.Listen(ctx, func(r *webpush.Receipt) { receipts <- r })
+
+	received := make(chan *Message)
+	go func() {
+		m, err := ua.Receive(ctx)
+		if err != nil {
+			t.Error(err)
+		}
+		received <- m
+	}()
+
+	// Let a long poll time out before the message is sent.
+	time.Sleep(80 * time.Millisecond)
+	result, err := webpush.SendWithOptions(nil, sub, "I am the walrus", &webpush.Options{ReceiptURI: rs.URI})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := <-received
+	if m == nil {
+		t.FailNow()
+	}
+	if string(m.Data) != "I am the walrus" {
+		t.Errorf("Received %q, expected %q", m.Data, "I am the walrus")
+	}
+	if m.URI != result.Location {
+		t.Errorf("Message resource was %v, expected %v", m.URI, result.Location)
+	}
+
+	if err := m.Acknowledge(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Messages()[0].Acknowledged {
+		t.Error("Expected the message to be acknowledged")
+	}
+	select {
+	case r := <-receipts:
+		if r.Message != result.Location {
+			t.Errorf("Receipt was for %v, expected %v", r.Message, result.Location)
+		}
+	case <-ctx.Done():
+		t.Fatal("Timed out waiting for a receipt")
+	}
+}
+
+func TestSubscriptionJSON(t *testing.T) {
+	s := webpushtest.NewServer()
+	defer s.Close()
+
+	ua, err := Subscribe(context.Background(), nil, s.SubscribeURI())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(ua)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var restored Subscription
+	if err := json.Unmarshal(b, &restored); err != nil {
+		t.Fatal(err)
+	}
+
+	// A message sent before the restart can be decrypted after it.
+	if _, err := webpush.SendWithOptions(nil, ua.Subscription, "Still here", nil); err != nil {
+		t.Fatal(err)
+	}
+	m, err := restored.Receive(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(m.Data) != "Still here" {
+		t.Errorf("Received %q, expected %q", m.Data, "Still here")
+	}
+}
+
+func TestParseLinks(t *testing.T) {
+	base, _ := url.Parse("https://push.example.net/subscribe")
+	links := parseLinks(base, []string{
+		`</push/JzLQ3raZJfFBR0aqvOMsLrt54w4rJUsV>; rel="urn:ietf:params:push"`,
+		`<https://push.example.net/receipts>;rel="urn:ietf:params:push:receipt", <bad;rel=other`,
+	})
+	if links[relPush] != "https://push.example.net/push/JzLQ3raZJfFBR0aqvOMsLrt54w4rJUsV" {
+		t.Errorf("Unexpected push resource %v", links[relPush])
+	}
+	if links[relReceipt] != "https://push.example.net/receipts" {
+		t.Errorf("Unexpected receipt subscribe resource %v", links[relReceipt])
+	}
+	if len(links) != 2 {
+		t.Errorf("Expected two links, got %v", links)
+	}
+}
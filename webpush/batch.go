@@ -0,0 +1,100 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webpush
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"text/template"
+)
+
+// Recipient is a subscription to send a personalized message to.
+type Recipient struct {
+	Subscription *Subscription
+	// Data is what the recipient's payload is made from, such as the data
+	// that a template is executed with.
+	Data interface{}
+}
+
+// PayloadFunc returns the payload of the message for a recipient.
+type PayloadFunc func(r *Recipient) (string, error)
+
+// RenderError is returned for a recipient whose payload couldn't be made.
+type RenderError struct {
+	Err error
+}
+
+func (e *RenderError) Error() string {
+	return "rendering payload: " + e.Err.Error()
+}
+
+// BatchResult is the outcome of sending to one recipient of a batch.
+type BatchResult struct {
+	Recipient *Recipient
+	// Payload is the payload that was made for the recipient.
+	Payload string
+	// Result is the push service's response, if the message was sent.
+	Result *Result
+	// Err is why the message wasn't sent: a *RenderError if the payload
+	// couldn't be made, a *PayloadTooLargeError if it was too long once
+	// signed and compressed as the Options ask, or the error from sending it.
+	Err error
+}
+
+// TemplateFuncs are functions for payload templates. The json function
+// encodes its argument as JSON, so that values can be put in JSON payloads
+// safely:
+//
+//	{"title": {{json .Title}}, "body": {{json .Body}}}
+var TemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// TemplatePayload returns a PayloadFunc that executes the template with each
+// recipient's Data.
+func TemplatePayload(tmpl *template.Template) PayloadFunc {
+	return func(r *Recipient) (string, error) {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, r.Data); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	}
+}
+
+// SendBatch makes each recipient's payload and sends it, as SendWithOptions
+// does. The results are in the same order as the recipients. A failure for
+// one recipient doesn't stop the others being sent to, so check each result's
+// Err.
+func SendBatch(client *http.Client, recipients []*Recipient, payload PayloadFunc, opts *Options) []*BatchResult {
+	results := make([]*BatchResult, len(recipients))
+	for i, r := range recipients {
+		br := &BatchResult{Recipient: r}
+		results[i] = br
+
+		p, err := payload(r)
+		if err != nil {
+			br.Err = &RenderError{err}
+			continue
+		}
+		br.Payload = p
+		br.Result, br.Err = SendWithOptions(client, r.Subscription, p, opts)
+	}
+	return results
+}
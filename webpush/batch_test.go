@@ -0,0 +1,111 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webpush
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+)
+
+// newDecryptingServer returns a push service that decrypts what it is sent
+// for the subscriptions in subs, keyed by the path of their endpoints.
+func newDecryptingServer(t *testing.T, received map[string]string) (*httptest.Server, func(name string) *Subscription) {
+	var mu sync.Mutex
+	keys := make(map[string][]byte)
+	subs := make(map[string]*Subscription)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := ioutil.ReadAll(r.Body)
+		result, err := ParseEncryptionResult(r.Header, body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		plaintext, err := Decrypt(subs[name], keys[name], result)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		received[name] = string(plaintext)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	return ts, func(name string) *Subscription {
+		sub, priv := newTestKeys(t)
+		sub.Endpoint = ts.URL + "/" + name
+		mu.Lock()
+		defer mu.Unlock()
+		subs[name], keys[name] = sub, priv
+		return sub
+	}
+}
+
+func TestSendBatchTemplate(t *testing.T) {
+	received := make(map[string]string)
+	ts, newSub := newDecryptingServer(t, received)
+	defer ts.Close()
+
+	tmpl := template.Must(template.New("campaign").Funcs(TemplateFuncs).Parse(
+		`{"title": {{json (printf "Hi %s" .Name)}}, "data": {"url": {{json .Link}}}}`))
+	type data struct{ Name, Link string }
+	recipients := []*Recipient{
+		{newSub("alice"), data{"Alice", "https://example.com/a"}},
+		{newSub("bob"), data{`Bob "the builder"`, "https://example.com/b"}},
+		{newSub("carol"), 42},
+		{newSub("dave"), data{strings.Repeat("d", 5000), ""}},
+	}
+
+	results := SendBatch(nil, recipients, TemplatePayload(tmpl), nil)
+	if len(results) != len(recipients) {
+		t.Fatalf("Expected %d results, got %d", len(recipients), len(results))
+	}
+
+	for i, name := range []string{"alice", "bob"} {
+		if results[i].Err != nil || results[i].Result.StatusCode != http.StatusCreated {
+			t.Errorf("%s: expected the message to be sent, got %v", name, results[i].Err)
+			continue
+		}
+		var n struct {
+			Title string
+			Data  struct{ URL string }
+		}
+		if err := json.Unmarshal([]byte(received[name]), &n); err != nil {
+			t.Errorf("%s: invalid JSON %s: %v", name, received[name], err)
+		}
+		if n.Title != "Hi "+recipients[i].Data.(data).Name || n.Data.URL != recipients[i].Data.(data).Link {
+			t.Errorf("%s: unexpected payload %s", name, received[name])
+		}
+	}
+
+	if _, ok := results[2].Err.(*RenderError); !ok {
+		t.Errorf("carol: expected a *RenderError, got %v", results[2].Err)
+	}
+	if _, ok := results[3].Err.(*PayloadTooLargeError); !ok {
+		t.Errorf("dave: expected a *PayloadTooLargeError, got %v", results[3].Err)
+	}
+	if _, ok := received["carol"]; ok {
+		t.Error("carol: expected nothing to be sent")
+	}
+	if _, ok := received["dave"]; ok {
+		t.Error("dave: expected nothing to be sent")
+	}
+}
@@ -0,0 +1,250 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webpush
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MaxChunks is the most push messages that content can be split across.
+const MaxChunks = 256
+
+// Chunk is one of the push messages that content too large for a single push
+// message is split into by SplitPayload. Its payload is JSON of the form
+//
+//	{"web_push_chunk": {"id": "...", "seq": 0, "total": 3, "data": "<base64>"}}
+//
+// so that a service worker can reassemble the content by concatenating the
+// base64 decoded data of every chunk with the same id in seq order.
+type Chunk struct {
+	// ID identifies the content that the chunk is part of.
+	ID string `json:"id"`
+	// Seq is the position of the chunk, from zero.
+	Seq int `json:"seq"`
+	// Total is the number of chunks the content was split into.
+	Total int `json:"total"`
+	// Data is this chunk's part of the content.
+	Data []byte `json:"data"`
+}
+
+// The JSON encoding of a push message carrying a Chunk.
+type chunkPayload struct {
+	Chunk *Chunk `json:"web_push_chunk"`
+}
+
+// SplitPayload splits the content into the payloads of as many push messages as
+// are needed for each to fit within the encoding's MaxPayloadLength. The
+// payloads should be sent with the same TTL, as the content can't be read
+// unless all of them are delivered.
+func SplitPayload(content []byte, encoding ContentEncoding) ([]string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	id := base64.RawURLEncoding.EncodeToString(b)
+
+	// Work out how much data fits beside the largest possible header.
+	empty, err := json.Marshal(chunkPayload{&Chunk{id, MaxChunks - 1, MaxChunks, []byte{}}})
+	if err != nil {
+		return nil, err
+	}
+	size := (MaxPayloadLength(encoding) - len(empty)) / 4 * 3
+
+	total := (len(content) + size - 1) / size
+	if total == 0 {
+		total = 1
+	}
+	if total > MaxChunks {
+		return nil, &PayloadTooLargeError{len(content), MaxChunks * size}
+	}
+
+	payloads := make([]string, total)
+	for seq := range payloads {
+		data := content[seq*size:]
+		if len(data) > size {
+			data = data[:size]
+		}
+		p, err := json.Marshal(chunkPayload{&Chunk{id, seq, total, data}})
+		if err != nil {
+			return nil, err
+		}
+		payloads[seq] = string(p)
+	}
+	return payloads, nil
+}
+
+// ParseChunk decodes the payload of a push message sent by SplitPayload.
+func ParseChunk(payload []byte) (*Chunk, error) {
+	var p chunkPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return nil, err
+	}
+	c := p.Chunk
+	if c == nil || c.ID == "" {
+		return nil, errors.New("payload is not a chunk")
+	}
+	if c.Total < 1 || c.Total > MaxChunks || c.Seq < 0 || c.Seq >= c.Total {
+		return nil, fmt.Errorf("chunk %d of %d is out of range", c.Seq, c.Total)
+	}
+	return c, nil
+}
+
+// DefaultChunkTimeout is how long a Reassembler waits for the rest of the
+// chunks of some content, unless its Timeout is set.
+const DefaultChunkTimeout = 5 * time.Minute
+
+// Reassembler puts chunks back together into the content they were split
+// from, in whatever order they arrive. Push services may deliver messages out
+// of order, more than once, or not at all, so content is given up on if its
+// chunks don't all arrive within Timeout of the first. A Reassembler is safe
+// for concurrent use.
+type Reassembler struct {
+	// Timeout is how long to wait for all of the chunks of some content. If
+	// zero, DefaultChunkTimeout is used.
+	Timeout time.Duration
+	// Now returns the current time. If nil, time.Now is used.
+	Now func() time.Time
+
+	mu      sync.Mutex
+	pending map[string]*partialContent
+	// When each content was completed, so that chunks redelivered within
+	// Timeout are dropped.
+	completed map[string]time.Time
+}
+
+// The chunks of some content received so far.
+type partialContent struct {
+	total  int
+	first  time.Time
+	chunks map[int][]byte
+}
+
+// IncompleteContent describes content that timed out before all of its chunks
+// arrived.
+type IncompleteContent struct {
+	ID    string
+	Total int
+	// Missing are the seq numbers of the chunks that didn't arrive.
+	Missing []int
+}
+
+func (r *Reassembler) now() time.Time {
+	if r.Now != nil {
+		return r.Now()
+	}
+	return time.Now()
+}
+
+func (r *Reassembler) timeout() time.Duration {
+	if r.Timeout == 0 {
+		return DefaultChunkTimeout
+	}
+	return r.Timeout
+}
+
+// Add adds a chunk, and returns the content once all of its chunks have been
+// added. Until then it returns nil. Duplicate chunks are ignored, including
+// chunks of content that was completed less than Timeout ago, as push services
+// can deliver a message more than once.
+func (r *Reassembler) Add(c *Chunk) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	if r.pending == nil {
+		r.pending = make(map[string]*partialContent)
+		r.completed = make(map[string]time.Time)
+	}
+	if done, ok := r.completed[c.ID]; ok {
+		if now.Sub(done) < r.timeout() {
+			return nil, nil
+		}
+		delete(r.completed, c.ID)
+	}
+	p, ok := r.pending[c.ID]
+	if ok && now.Sub(p.first) >= r.timeout() {
+		// The earlier chunks timed out, so start again from this one.
+		ok = false
+	}
+	if !ok {
+		p = &partialContent{total: c.Total, first: now, chunks: make(map[int][]byte)}
+		r.pending[c.ID] = p
+	}
+	if c.Total != p.total {
+		return nil, fmt.Errorf("chunk %d of content %s has total %d, expected %d", c.Seq, c.ID, c.Total, p.total)
+	}
+	if c.Seq < 0 || c.Seq >= p.total {
+		return nil, fmt.Errorf("chunk %d of content %s is out of range", c.Seq, c.ID)
+	}
+	if _, dup := p.chunks[c.Seq]; !dup {
+		p.chunks[c.Seq] = c.Data
+	}
+	if len(p.chunks) < p.total {
+		return nil, nil
+	}
+
+	delete(r.pending, c.ID)
+	r.completed[c.ID] = now
+	var buf bytes.Buffer
+	for seq := 0; seq < p.total; seq++ {
+		buf.Write(p.chunks[seq])
+	}
+	return buf.Bytes(), nil
+}
+
+// Expire gives up on content whose chunks haven't all arrived within Timeout,
+// and returns what it was missing. It also forgets content that was completed
+// more than Timeout ago.
+func (r *Reassembler) Expire() []*IncompleteContent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	for id, done := range r.completed {
+		if now.Sub(done) >= r.timeout() {
+			delete(r.completed, id)
+		}
+	}
+	var expired []*IncompleteContent
+	for id, p := range r.pending {
+		if now.Sub(p.first) < r.timeout() {
+			continue
+		}
+		ic := &IncompleteContent{ID: id, Total: p.total}
+		for seq := 0; seq < p.total; seq++ {
+			if _, ok := p.chunks[seq]; !ok {
+				ic.Missing = append(ic.Missing, seq)
+			}
+		}
+		expired = append(expired, ic)
+		delete(r.pending, id)
+	}
+	sort.Sort(byID(expired))
+	return expired
+}
+
+type byID []*IncompleteContent
+
+func (s byID) Len() int           { return len(s) }
+func (s byID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+func (s byID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,182 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webpush
+
+import (
+	"bytes"
+	"crypto/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func splitAndParse(t *testing.T, content []byte, encoding ContentEncoding) []*Chunk {
+	payloads, err := SplitPayload(content, encoding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := make([]*Chunk, len(payloads))
+	for i, p := range payloads {
+		if len(p) > MaxPayloadLength(encoding) {
+			t.Errorf("Payload %d is %d bytes", i, len(p))
+		}
+		if chunks[i], err = ParseChunk([]byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return chunks
+}
+
+func TestSplitPayload(t *testing.T) {
+	content := make([]byte, 10000)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, encoding := range []ContentEncoding{AESGCM, AES128GCM} {
+		chunks := splitAndParse(t, content, encoding)
+		if len(chunks) != 4 {
+			t.Errorf("%v: expected 4 chunks, got %d", encoding, len(chunks))
+		}
+		var joined []byte
+		for i, c := range chunks {
+			if c.ID != chunks[0].ID || c.Seq != i || c.Total != len(chunks) {
+				t.Errorf("%v: unexpected chunk %d: %s %d/%d", encoding, i, c.ID, c.Seq, c.Total)
+			}
+			joined = append(joined, c.Data...)
+		}
+		if !bytes.Equal(joined, content) {
+			t.Errorf("%v: chunks don't join up to the content", encoding)
+		}
+	}
+
+	if chunks := splitAndParse(t, nil, AES128GCM); len(chunks) != 1 || len(chunks[0].Data) != 0 {
+		t.Errorf("Expected one empty chunk for empty content, got %v", chunks)
+	}
+	if _, err := SplitPayload(make([]byte, MaxChunks*4096), AES128GCM); err == nil {
+		t.Error("Expected an error for content needing too many chunks")
+	}
+}
+
+func TestParseChunkErrors(t *testing.T) {
+	tests := []string{
+		`{"title": "Hi"}`,
+		`{"web_push_chunk": {"id": "a", "seq": 2, "total": 2, "data": ""}}`,
+		`{"web_push_chunk": {"id": "a", "seq": -1, "total": 2, "data": ""}}`,
+		`{"web_push_chunk": {"id": "a", "seq": 0, "total": 1000, "data": ""}}`,
+		`{"web_push_chunk": {"seq": 0, "total": 1, "data": ""}}`,
+	}
+	for _, test := range tests {
+		if _, err := ParseChunk([]byte(test)); err == nil {
+			t.Errorf("%s: expected an error", test)
+		}
+	}
+}
+
+func TestReassembler(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 800)
+	chunks := splitAndParse(t, content, AES128GCM)
+	if len(chunks) != 3 {
+		t.Fatalf("Expected 3 chunks, got %d", len(chunks))
+	}
+
+	r := &Reassembler{}
+	for _, i := range []int{2, 0, 2} {
+		if got, err := r.Add(chunks[i]); got != nil || err != nil {
+			t.Fatalf("Expected nothing after chunk %d, got %v, %v", i, got, err)
+		}
+	}
+	bad := *chunks[0]
+	bad.Total = 5
+	if _, err := r.Add(&bad); err == nil {
+		t.Error("Expected an error for a chunk with a different total")
+	}
+	got, err := r.Add(chunks[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Error("Reassembled content does not match")
+	}
+	if got, _ := r.Add(chunks[1]); got != nil {
+		t.Error("Expected a late duplicate not to complete the content again")
+	}
+}
+
+func TestReassemblerTimeout(t *testing.T) {
+	now := time.Now()
+	r := &Reassembler{Timeout: time.Minute, Now: func() time.Time { return now }}
+
+	first := splitAndParse(t, make([]byte, 10000), AES128GCM)
+	second := splitAndParse(t, make([]byte, 10000), AES128GCM)
+	r.Add(first[1])
+	now = now.Add(30 * time.Second)
+	r.Add(second[0])
+	r.Add(second[2])
+
+	if expired := r.Expire(); len(expired) != 0 {
+		t.Errorf("Expected nothing to expire yet, got %v", expired)
+	}
+	now = now.Add(30 * time.Second)
+	expired := r.Expire()
+	if len(expired) != 1 || expired[0].ID != first[0].ID || !reflect.DeepEqual(expired[0].Missing, []int{0, 2, 3}) {
+		t.Errorf("Expected the first content to expire missing 0, 2 and 3, got %+v", expired)
+	}
+
+	// Chunks of expired content start again rather than completing it.
+	for _, c := range first[:3] {
+		r.Add(c)
+	}
+	now = now.Add(time.Minute)
+	for _, c := range first[3:] {
+		if got, _ := r.Add(c); got != nil {
+			t.Error("Expected chunks that timed out not to complete the content")
+		}
+	}
+	if got, _ := r.Add(second[1]); got != nil {
+		t.Error("Expected the second content to have timed out")
+	}
+}
+
+func TestReassemblerRedelivery(t *testing.T) {
+	now := time.Now()
+	r := &Reassembler{Timeout: time.Minute, Now: func() time.Time { return now }}
+
+	single := splitAndParse(t, []byte("hello"), AESGCM)
+	if got, err := r.Add(single[0]); string(got) != "hello" || err != nil {
+		t.Fatalf("Expected hello, got %q, %v", got, err)
+	}
+	if got, err := r.Add(single[0]); got != nil || err != nil {
+		t.Errorf("Expected a redelivered chunk to be dropped, got %q, %v", got, err)
+	}
+
+	chunks := splitAndParse(t, make([]byte, 10000), AES128GCM)
+	for _, c := range chunks {
+		r.Add(c)
+	}
+	now = now.Add(30 * time.Second)
+	if got, _ := r.Add(chunks[1]); got != nil {
+		t.Error("Expected a redelivered chunk to be dropped")
+	}
+	now = now.Add(time.Minute)
+	if expired := r.Expire(); len(expired) != 0 {
+		t.Errorf("Expected redelivered chunks not to leave incomplete content, got %+v", expired)
+	}
+
+	// Once Timeout has passed, the ID can be used again.
+	if got, _ := r.Add(single[0]); string(got) != "hello" {
+		t.Errorf("Expected hello after the timeout, got %q", got)
+	}
+}
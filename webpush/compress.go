@@ -0,0 +1,75 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webpush
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// CompressedMarker is the first byte of a compressed payload. It can't begin
+// UTF-8 text, so text payloads that weren't compressed are told apart from
+// compressed ones.
+const CompressedMarker = 0xff
+
+// MaxDecompressedLength is the longest payload that DecompressPayload will
+// inflate, to stop a small message expanding to use all of the memory.
+const MaxDecompressedLength = 1 << 20
+
+// CompressPayload compresses a payload with raw deflate (RFC 1951) and puts
+// CompressedMarker before it. If that doesn't make it shorter, the payload is
+// returned as it is. Compressed payloads are decoded by DecompressPayload, or
+// in a service worker with:
+//
+//	async function decodePayload(event) {
+//	  const data = new Uint8Array(await event.data.arrayBuffer());
+//	  if (data[0] !== 0xff) return new TextDecoder().decode(data);
+//	  const stream = new Blob([data.subarray(1)]).stream()
+//	      .pipeThrough(new DecompressionStream('deflate-raw'));
+//	  return new Response(stream).text();
+//	}
+func CompressPayload(payload string) string {
+	var buf bytes.Buffer
+	buf.WriteByte(CompressedMarker)
+	w, _ := flate.NewWriter(&buf, flate.BestCompression)
+	io.WriteString(w, payload)
+	w.Close()
+	if buf.Len() >= len(payload) {
+		return payload
+	}
+	return buf.String()
+}
+
+// DecompressPayload returns a payload made by CompressPayload as it was
+// before it was compressed. Payloads that don't start with CompressedMarker
+// are returned unchanged.
+func DecompressPayload(payload []byte) ([]byte, error) {
+	if len(payload) == 0 || payload[0] != CompressedMarker {
+		return payload, nil
+	}
+	r := flate.NewReader(bytes.NewReader(payload[1:]))
+	defer r.Close()
+	decompressed, err := ioutil.ReadAll(io.LimitReader(r, MaxDecompressedLength+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(decompressed) > MaxDecompressedLength {
+		return nil, errors.New("decompressed payload is too large")
+	}
+	return decompressed, nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webpush
+
+import (
+	"bytes"
+	"compress/flate"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCompressPayload(t *testing.T) {
+	message := `{"items": [` + strings.Repeat(`{"title": "Something happened", "read": false},`, 100) + `{}]}`
+	compressed := CompressPayload(message)
+	if compressed[0] != CompressedMarker {
+		t.Fatal("Expected the payload to start with the marker")
+	}
+	if len(compressed) >= len(message) {
+		t.Errorf("Expected the payload to be shorter than %d bytes, was %d", len(message), len(compressed))
+	}
+	decompressed, err := DecompressPayload([]byte(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decompressed) != message {
+		t.Errorf("Expected %q, got %q", message, decompressed)
+	}
+
+	for _, short := range []string{"", "Hi"} {
+		if got := CompressPayload(short); got != short {
+			t.Errorf("Expected %q to be left as it is, got %q", short, got)
+		}
+		if got, err := DecompressPayload([]byte(short)); err != nil || string(got) != short {
+			t.Errorf("Expected %q to be decoded as it is, got %q, %v", short, got, err)
+		}
+	}
+}
+
+func TestDecompressPayloadErrors(t *testing.T) {
+	if _, err := DecompressPayload([]byte{CompressedMarker, 1, 2, 3}); err == nil {
+		t.Error("Expected an error for invalid deflate data")
+	}
+
+	var bomb bytes.Buffer
+	bomb.WriteByte(CompressedMarker)
+	w, _ := flate.NewWriter(&bomb, flate.BestCompression)
+	w.Write(make([]byte, MaxDecompressedLength+1))
+	w.Close()
+	if _, err := DecompressPayload(bomb.Bytes()); err == nil {
+		t.Error("Expected an error for a payload that inflates too far")
+	}
+}
+
+func TestSendCompressed(t *testing.T) {
+	received := make(map[string]string)
+	ts, newSub := newDecryptingServer(t, received)
+	defer ts.Close()
+	sub := newSub("sub")
+
+	message := strings.Repeat("All work and no play makes Jack a dull boy. ", 200)
+	if _, err := SendWithOptions(nil, sub, message, nil); err == nil {
+		t.Fatalf("Expected a %d byte message to be too large", len(message))
+	}
+
+	result, err := SendWithOptions(nil, sub, message, &Options{Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", result.StatusCode, result.Body)
+	}
+	decompressed, err := DecompressPayload([]byte(received["sub"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decompressed) != message {
+		t.Errorf("Expected the message to arrive intact, got %q", decompressed)
+	}
+}
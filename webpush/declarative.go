@@ -0,0 +1,179 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webpush
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// declarativeMagic is the value of the web_push member that marks a
+// declarative push message.
+const declarativeMagic = 8030
+
+// DeclarativePush is a Declarative Web Push message, which browsers that
+// support it, such as Safari, show as a notification without running a
+// service worker. If there is a service worker and Mutable is set, its push
+// event can change the notification first.
+type DeclarativePush struct {
+	Notification DeclarativeNotification `json:"notification"`
+	// AppBadge sets the application's badge, if not nil.
+	AppBadge *uint64 `json:"app_badge,omitempty"`
+	// Mutable lets the service worker change the notification.
+	Mutable bool `json:"mutable,omitempty"`
+}
+
+// DeclarativeNotification is the notification of a DeclarativePush. Title and
+// Navigate are required.
+type DeclarativeNotification struct {
+	Title string `json:"title"`
+	// Navigate is the absolute URL opened when the notification is clicked.
+	Navigate           string              `json:"navigate"`
+	Body               string              `json:"body,omitempty"`
+	Lang               string              `json:"lang,omitempty"`
+	Dir                string              `json:"dir,omitempty"`
+	Tag                string              `json:"tag,omitempty"`
+	Image              string              `json:"image,omitempty"`
+	Icon               string              `json:"icon,omitempty"`
+	Badge              string              `json:"badge,omitempty"`
+	Timestamp          int64               `json:"timestamp,omitempty"`
+	Renotify           bool                `json:"renotify,omitempty"`
+	Silent             bool                `json:"silent,omitempty"`
+	RequireInteraction bool                `json:"require_interaction,omitempty"`
+	Actions            []DeclarativeAction `json:"actions,omitempty"`
+	// Data is any JSON encodable value for the service worker.
+	Data interface{} `json:"data,omitempty"`
+}
+
+// DeclarativeAction is a button shown with a declarative notification, which
+// opens Navigate when clicked.
+type DeclarativeAction struct {
+	Action   string `json:"action,omitempty"`
+	Title    string `json:"title"`
+	Navigate string `json:"navigate"`
+	Icon     string `json:"icon,omitempty"`
+}
+
+// The fields of a DeclarativePush, without its MarshalJSON method.
+type declarativePushFields DeclarativePush
+
+// The JSON encoding of a DeclarativePush.
+type declarativePushJSON struct {
+	WebPush int `json:"web_push"`
+	declarativePushFields
+}
+
+// MarshalJSON encodes the message with the web_push member that identifies it
+// as declarative.
+func (d *DeclarativePush) MarshalJSON() ([]byte, error) {
+	return json.Marshal(declarativePushJSON{declarativeMagic, declarativePushFields(*d)})
+}
+
+// ParseDeclarativePush decodes and validates a declarative push message.
+func ParseDeclarativePush(b []byte) (*DeclarativePush, error) {
+	var d declarativePushJSON
+	if err := json.Unmarshal(b, &d); err != nil {
+		return nil, err
+	}
+	if d.WebPush != declarativeMagic {
+		return nil, fmt.Errorf("web_push is %d, not %d", d.WebPush, declarativeMagic)
+	}
+	push := DeclarativePush(d.declarativePushFields)
+	if err := push.Validate(); err != nil {
+		return nil, err
+	}
+	return &push, nil
+}
+
+// Validate checks that the message has the members that browsers require.
+func (d *DeclarativePush) Validate() error {
+	n := &d.Notification
+	if n.Title == "" {
+		return errors.New("declarative notification must have a title")
+	}
+	if err := validNavigate(n.Navigate); err != nil {
+		return err
+	}
+	switch n.Dir {
+	case "", "auto", "ltr", "rtl":
+	default:
+		return fmt.Errorf("declarative notification dir %q must be auto, ltr or rtl", n.Dir)
+	}
+	for i, a := range n.Actions {
+		if a.Title == "" {
+			return fmt.Errorf("declarative notification action %d must have a title", i)
+		}
+		if err := validNavigate(a.Navigate); err != nil {
+			return fmt.Errorf("declarative notification action %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// validNavigate checks that a navigate URL is an absolute http or https URL.
+func validNavigate(navigate string) error {
+	if navigate == "" {
+		return errors.New("declarative notification must have a navigate URL")
+	}
+	u, err := url.Parse(navigate)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("navigate %q must be an absolute http or https URL", navigate)
+	}
+	return nil
+}
+
+// Payload validates the message and returns its JSON encoding, or a
+// *PayloadTooLargeError if it is too long to encrypt with the encoding.
+func (d *DeclarativePush) Payload(encoding ContentEncoding) (string, error) {
+	b, err := d.marshal()
+	if err != nil {
+		return "", err
+	}
+	if max := MaxPayloadLength(encoding); len(b) > max {
+		return "", &PayloadTooLargeError{len(b), max}
+	}
+	return string(b), nil
+}
+
+// TruncatedPayload is like Payload, but shortens the body of the notification
+// to fit, as Notification.TruncatedPayload does.
+func (d *DeclarativePush) TruncatedPayload(encoding ContentEncoding) (string, error) {
+	return truncateBody(d.Notification.Body, func(body string) (string, error) {
+		truncated := *d
+		truncated.Notification.Body = body
+		return truncated.Payload(encoding)
+	})
+}
+
+// TruncatedPayloadFor is like TruncatedPayload, measuring the message with
+// the encoding that SendWithOptions uses for the subscription with opts. A
+// declarative message can't be signed or compressed, as its top-level
+// web_push member must be read by the browser, so an error is returned if
+// Options.PayloadSigner or Options.Compress is set.
+func (d *DeclarativePush) TruncatedPayloadFor(sub *Subscription, opts *Options) (string, error) {
+	if opts != nil && (opts.PayloadSigner != nil || opts.Compress) {
+		return "", errors.New("declarative push messages can't be signed or compressed")
+	}
+	return d.TruncatedPayload(opts.encoding(DetectProvider(sub.Endpoint)))
+}
+
+func (d *DeclarativePush) marshal() ([]byte, error) {
+	if err := d.Validate(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(d)
+}
@@ -0,0 +1,120 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webpush
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDeclarativePushPayload(t *testing.T) {
+	badge := uint64(3)
+	d := &DeclarativePush{
+		Notification: DeclarativeNotification{
+			Title:    "New message",
+			Navigate: "https://example.com/chat/1",
+			Body:     "Hello",
+			Actions:  []DeclarativeAction{{Action: "reply", Title: "Reply", Navigate: "https://example.com/chat/1#reply"}},
+		},
+		AppBadge: &badge,
+		Mutable:  true,
+	}
+	payload, err := d.Payload(AES128GCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"web_push":8030,"notification":{"title":"New message","navigate":"https://example.com/chat/1","body":"Hello","actions":[{"action":"reply","title":"Reply","navigate":"https://example.com/chat/1#reply"}]},"app_badge":3,"mutable":true}`
+	if payload != expected {
+		t.Errorf("Expected %s, got %s", expected, payload)
+	}
+
+	parsed, err := ParseDeclarativePush([]byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Notification.Title != "New message" || *parsed.AppBadge != 3 || !parsed.Mutable || len(parsed.Notification.Actions) != 1 {
+		t.Errorf("Unexpected parsed message %+v", parsed)
+	}
+}
+
+func TestDeclarativePushValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		n    DeclarativeNotification
+	}{
+		{"no title", DeclarativeNotification{Navigate: "https://example.com/"}},
+		{"no navigate", DeclarativeNotification{Title: "Hi"}},
+		{"relative navigate", DeclarativeNotification{Title: "Hi", Navigate: "/chat"}},
+		{"javascript navigate", DeclarativeNotification{Title: "Hi", Navigate: "javascript:alert(1)"}},
+		{"bad dir", DeclarativeNotification{Title: "Hi", Navigate: "https://example.com/", Dir: "up"}},
+		{"action without navigate", DeclarativeNotification{Title: "Hi", Navigate: "https://example.com/", Actions: []DeclarativeAction{{Title: "Open"}}}},
+		{"action without title", DeclarativeNotification{Title: "Hi", Navigate: "https://example.com/", Actions: []DeclarativeAction{{Navigate: "https://example.com/"}}}},
+	}
+	for _, test := range tests {
+		d := &DeclarativePush{Notification: test.n}
+		if err := d.Validate(); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+		if _, err := d.Payload(AES128GCM); err == nil {
+			t.Errorf("%s: expected Payload to validate", test.name)
+		}
+	}
+
+	if _, err := ParseDeclarativePush([]byte(`{"notification": {"title": "Hi", "navigate": "https://example.com/"}}`)); err == nil {
+		t.Error("Expected an error without web_push")
+	}
+	if _, err := ParseDeclarativePush([]byte(`{"web_push": 8030, "notification": {"title": "Hi"}}`)); err == nil {
+		t.Error("Expected an error without navigate")
+	}
+}
+
+func TestDeclarativePushTruncatedPayload(t *testing.T) {
+	d := &DeclarativePush{Notification: DeclarativeNotification{
+		Title:    "Hi",
+		Navigate: "https://example.com/",
+		Body:     strings.Repeat("é", 3000),
+	}}
+	if _, err := d.Payload(AESGCM); err == nil {
+		t.Fatal("Expected the payload to be too large")
+	}
+	payload, err := d.TruncatedPayload(AESGCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payload) > 4078 {
+		t.Errorf("Payload is %d bytes", len(payload))
+	}
+	parsed, err := ParseDeclarativePush([]byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(parsed.Notification.Body, ellipsis) {
+		t.Error("Expected the body to be truncated")
+	}
+
+	sub := &Subscription{Endpoint: "https://web.push.apple.com/QGuQyavXut"}
+	payload, err = d.TruncatedPayloadFor(sub, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if longer, _ := d.TruncatedPayload(AES128GCM); payload != longer {
+		t.Errorf("Expected the payload to be truncated for aes128gcm, got %d bytes", len(payload))
+	}
+	for _, opts := range []*Options{{PayloadSigner: newTestVAPID(t)}, {Compress: true}} {
+		if _, err := d.TruncatedPayloadFor(sub, opts); err == nil {
+			t.Errorf("Expected an error truncating for %+v", opts)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webpush
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/googlechrome/push-encryption-go/ece"
+)
+
+// ParseEncryptionResult reads an encrypted push message from the headers and
+// body of an HTTP message. It is the inverse of EncryptionResult.Apply.
+func ParseEncryptionResult(h http.Header, body []byte) (*EncryptionResult, error) {
+	var encoding ContentEncoding
+	if err := encoding.UnmarshalText([]byte(h.Get("Content-Encoding"))); err != nil {
+		return nil, err
+	}
+
+	if encoding == AES128GCM {
+		header, err := ParseAES128GCMHeader(body)
+		if err != nil {
+			return nil, err
+		}
+		return &EncryptionResult{body, header.Salt, header.KeyID, encoding}, nil
+	}
+
+	salt, err := headerParam(h, "Encryption", "salt")
+	if err != nil {
+		return nil, err
+	}
+	dh, err := headerParam(h, "Crypto-Key", "dh")
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptionResult{body, salt, dh, encoding}, nil
+}
+
+// Decrypt a message encrypted by Encrypt, as a user agent would. The
+// subscription must be the one the message was encrypted for, and priv the
+// private key matching its public key.
+func Decrypt(sub *Subscription, priv []byte, result *EncryptionResult) ([]byte, error) {
+	if len(sub.Key) == 0 || len(sub.Auth) == 0 {
+		return nil, errors.New("subscription must include the client's public key and auth value")
+	}
+
+	if result.Encoding == AES128GCM {
+		// The key id of the content coding is the server public key.
+		return ece.Decrypt(result.Ciphertext, func(serverPublicKey []byte) ([]byte, error) {
+			secret, err := sharedSecret(curve, serverPublicKey, priv)
+			if err != nil {
+				return nil, err
+			}
+			keyInfo := newKeyInfo(sub.Key, serverPublicKey)
+			return hkdf(sub.Auth, secret, keyInfo, 32), nil
+		})
+	}
+
+	secret, err := sharedSecret(curve, result.ServerPublicKey, priv)
+	if err != nil {
+		return nil, err
+	}
+	prk := hkdf(sub.Auth, secret, authInfo, 32)
+	ctx := newContext(sub.Key, result.ServerPublicKey)
+	cek, err := newCEK(ctx, result.Salt, prk, result.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	nonce := newNonce(ctx, result.Salt, prk)
+
+	c, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(c)
+	if err != nil {
+		return nil, err
+	}
+	data, err := gcm.Open(nil, nonce, result.Ciphertext, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Remove the padding, a uint16 size followed by that many bytes.
+	if len(data) < 2 {
+		return nil, errors.New("decrypted message is too short to hold its padding length")
+	}
+	padding := int(binary.BigEndian.Uint16(data)) + 2
+	if padding > len(data) {
+		return nil, fmt.Errorf("padding of %d bytes is longer than the message", padding)
+	}
+	return data[padding:], nil
+}
+
+// headerParam finds a base64 encoded parameter like "salt=..." in a header
+// whose value is a list of parameters separated by ";" or ",".
+func headerParam(h http.Header, header, name string) ([]byte, error) {
+	fields := strings.FieldsFunc(h.Get(header), func(r rune) bool {
+		return r == ';' || r == ','
+	})
+	for _, field := range fields {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) == 2 && strings.EqualFold(kv[0], name) {
+			value := strings.TrimRight(strings.Trim(kv[1], `"`), "=")
+			return base64.URLEncoding.WithPadding(base64.NoPadding).DecodeString(value)
+		}
+	}
+	return nil, fmt.Errorf("%s header has no %s parameter", header, name)
+}
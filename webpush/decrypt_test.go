@@ -0,0 +1,92 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webpush
+
+import (
+	"crypto/rand"
+	"net/http"
+	"testing"
+)
+
+func newTestKeys(t *testing.T) (*Subscription, []byte) {
+	priv, pub, err := randomKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := make([]byte, 16)
+	if _, err := rand.Read(auth); err != nil {
+		t.Fatal(err)
+	}
+	return &Subscription{Endpoint: "https://example.com/", Key: pub, Auth: auth}, priv
+}
+
+func TestDecrypt(t *testing.T) {
+	sub, priv := newTestKeys(t)
+
+	for _, encoding := range []ContentEncoding{AESGCM, AES128GCM} {
+		result, err := Encrypt(sub, message, encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Go through HTTP headers, as a user agent would.
+		h := http.Header{}
+		result.ApplyHeaders(h)
+		parsed, err := ParseEncryptionResult(h, result.Ciphertext)
+		if err != nil {
+			t.Fatalf("%v: %v", encoding, err)
+		}
+
+		plaintext, err := Decrypt(sub, priv, parsed)
+		if err != nil {
+			t.Fatalf("%v: %v", encoding, err)
+		}
+		if string(plaintext) != message {
+			t.Errorf("%v: decrypted %q, expected %q", encoding, plaintext, message)
+		}
+
+		other, _ := newTestKeys(t)
+		if _, err := Decrypt(other, priv, parsed); err == nil {
+			t.Errorf("%v: expected an error decrypting with the wrong auth secret", encoding)
+		}
+	}
+}
+
+func TestParseEncryptionResult(t *testing.T) {
+	h := http.Header{}
+	h.Set("Content-Encoding", "aesgcm")
+	h.Set("Encryption", "keyid=p256dh;salt=AAECAw")
+	h.Set("Crypto-Key", `keyid=p256dh;dh="BAEC==", p256ecdsa=BAUG`)
+	result, err := ParseEncryptionResult(h, []byte("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result.Salt) != "\x00\x01\x02\x03" || string(result.ServerPublicKey) != "\x04\x01\x02" {
+		t.Errorf("Unexpected salt %v and key %v", result.Salt, result.ServerPublicKey)
+	}
+
+	h.Del("Encryption")
+	if _, err := ParseEncryptionResult(h, []byte("body")); err == nil {
+		t.Error("Expected an error due to missing salt")
+	}
+	h.Set("Content-Encoding", "gzip")
+	if _, err := ParseEncryptionResult(h, []byte("body")); err == nil {
+		t.Error("Expected an error due to unknown encoding")
+	}
+	h.Set("Content-Encoding", "aes128gcm")
+	if _, err := ParseEncryptionResult(h, []byte("body")); err == nil {
+		t.Error("Expected an error due to short aes128gcm body")
+	}
+}
@@ -22,7 +22,7 @@
 //
 //   func main() {
 //     // The values that make up the Subscription struct come from the browser
-//     sub := &webpush.Subscription{endpoint, key, auth}
+//     sub := &webpush.Subscription{Endpoint: endpoint, Key: key, Auth: auth}
 //     webpush.Send(nil, sub, "Yay! Web Push!", "")
 //   }
 //
@@ -32,12 +32,13 @@
 //   var exampleJSON = []byte(`{"endpoint": "...", "keys": {"p256dh": "...", "auth": "..."}}`)
 //   sub, err := SubscriptionFromJSON(exampleJSON)
 //
-// If the push service requires an authentication header (notably Google Cloud
-// Messaging, used by Chrome) then you can add that as a fourth parameter:
+// If the push service requires an authentication header then you can add that
+// as a fourth parameter:
 //
-//   if strings.Contains(sub.Endpoint, "https://android.googleapis.com/gcm/send/") {
-//     webpush.Send(nil, sub, "A message for Chrome", myGCMKey)
-//   }
+//   webpush.Send(nil, sub, "A message", myKey)
+//
+// Endpoints of the shut down Google Cloud Messaging service are refused. Set
+// Options.EndpointPolicy to change which endpoints are allowed.
 package webpush
 
 import (
@@ -53,6 +54,8 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+
+	"github.com/googlechrome/push-encryption-go/ece"
 )
 
 // ContentEncoding indicates the version of encoding.
@@ -76,6 +79,27 @@ func (v ContentEncoding) String() string {
 	return "unknown"
 }
 
+// MarshalText encodes the content encoding as its HTTP Content-Encoding token.
+func (v ContentEncoding) MarshalText() ([]byte, error) {
+	if v != AESGCM && v != AES128GCM {
+		return nil, fmt.Errorf("unknown content encoding %d", int(v))
+	}
+	return []byte(v.String()), nil
+}
+
+// UnmarshalText parses an HTTP Content-Encoding token such as "aes128gcm".
+func (v *ContentEncoding) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "aesgcm":
+		*v = AESGCM
+	case "aes128gcm":
+		*v = AES128GCM
+	default:
+		return fmt.Errorf("unknown content encoding %q", text)
+	}
+	return nil
+}
+
 const (
 	aesgcmMaxPayloadLength = 4078
 	// Due to the additional binary message header, the max playload length for
@@ -117,6 +141,10 @@ var (
 
 // Subscription holds the useful values from a PushSubscription object acquired
 // from the browser
+//
+// Fields may be added to Subscription, so create it with a keyed literal such
+// as Subscription{Endpoint: endpoint, Key: key, Auth: auth}. Unkeyed literals
+// stopped compiling when ApplicationServerKey was added.
 type Subscription struct {
 	// Endpoint is the URL to send the Web Push message to. Comes from the
 	// endpoint field of the PushSubscription.
@@ -126,21 +154,83 @@ type Subscription struct {
 	// Auth is a value used by the client to validate the encryption. From the
 	// keys.auth field.
 	Auth []byte
+	// ApplicationServerKey is the VAPID public key that the subscription was
+	// created with, if known. Browsers leave it out of the JSON, so it must be
+	// added by the page from the subscription's options. See VAPIDKeyRing.
+	ApplicationServerKey []byte
+	// Locale is the BCP 47 language tag of the subscriber's preferred
+	// language, such as "pt-BR", if known. Like ApplicationServerKey, it must
+	// be added to the JSON by the page, for example from navigator.language.
+	Locale string
 }
 
 // SubscriptionFromJSON is a convenience function that takes a JSON encoded
 // PushSubscription object acquired from the browser and returns a pointer to a
 // Subscription
 func SubscriptionFromJSON(b []byte) (*Subscription, error) {
-	var sub struct {
-		Endpoint string
-		Keys     struct {
-			P256dh string
-			Auth   string
-		}
+	sub := &Subscription{}
+	if err := json.Unmarshal(b, sub); err != nil {
+		return nil, err
 	}
+	return sub, nil
+}
+
+// The JSON format of a PushSubscription, as returned by its toJSON method.
+type pushSubscriptionJSON struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+	ApplicationServerKey string `json:"applicationServerKey,omitempty"`
+	Locale               string `json:"locale,omitempty"`
+}
+
+// MarshalJSON encodes the subscription in the same format as a browser's
+// PushSubscription, so that it can be read by SubscriptionFromJSON.
+func (s *Subscription) MarshalJSON() ([]byte, error) {
+	b64 := base64.URLEncoding.WithPadding(base64.NoPadding)
+
+	var sub pushSubscriptionJSON
+	sub.Endpoint = s.Endpoint
+	sub.Keys.P256dh = b64.EncodeToString(s.Key)
+	sub.Keys.Auth = b64.EncodeToString(s.Auth)
+	sub.ApplicationServerKey = b64.EncodeToString(s.ApplicationServerKey)
+	sub.Locale = s.Locale
+	return json.Marshal(sub)
+}
+
+// The JSON format that Subscriptions had before they had a MarshalJSON method,
+// with the keys in standard base64.
+type legacySubscriptionJSON struct {
+	Endpoint string
+	Key      []byte
+	Auth     []byte
+}
+
+// UnmarshalJSON decodes a JSON encoded PushSubscription object. It also reads
+// the {"Endpoint", "Key", "Auth"} form that encoding/json gave Subscriptions
+// before they had a MarshalJSON method. An error is returned if the keys are
+// missing.
+func (s *Subscription) UnmarshalJSON(b []byte) error {
+	var sub pushSubscriptionJSON
 	if err := json.Unmarshal(b, &sub); err != nil {
-		return nil, err
+		return err
+	}
+	if sub.Keys.P256dh == "" && sub.Keys.Auth == "" {
+		// Either the legacy encoding, or a subscription without keys, which
+		// can only be sent messages without a payload.
+		var legacy legacySubscriptionJSON
+		if err := json.Unmarshal(b, &legacy); err != nil {
+			return err
+		}
+		if len(legacy.Key) != 0 || len(legacy.Auth) != 0 {
+			if len(legacy.Key) == 0 || len(legacy.Auth) == 0 {
+				return errors.New("subscription is missing a key")
+			}
+			*s = Subscription{Endpoint: legacy.Endpoint, Key: legacy.Key, Auth: legacy.Auth}
+			return nil
+		}
 	}
 
 	b64 := base64.URLEncoding.WithPadding(base64.NoPadding)
@@ -149,24 +239,66 @@ func SubscriptionFromJSON(b []byte) (*Subscription, error) {
 	// we need to strip that out
 	key, err := b64.DecodeString(strings.TrimRight(sub.Keys.P256dh, "="))
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	auth, err := b64.DecodeString(strings.TrimRight(sub.Keys.Auth, "="))
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return &Subscription{sub.Endpoint, key, auth}, nil
+	serverKey, err := b64.DecodeString(strings.TrimRight(sub.ApplicationServerKey, "="))
+	if err != nil {
+		return err
+	}
+	if len(serverKey) == 0 {
+		serverKey = nil
+	}
+
+	*s = Subscription{
+		Endpoint:             sub.Endpoint,
+		Key:                  key,
+		Auth:                 auth,
+		ApplicationServerKey: serverKey,
+		Locale:               sub.Locale,
+	}
+	return nil
 }
 
 // EncryptionResult stores the result of encrypting a message. The ciphertext is
 // the actual encrypted message, while the salt and server public key are
 // required to be sent to the client so that the message can be decrypted.
+//
+// An EncryptionResult can be marshaled to JSON, so that a message can be
+// encrypted in one process and delivered by another. Use Apply or ApplyHeaders
+// to turn it into a push request.
 type EncryptionResult struct {
-	Ciphertext      []byte
-	Salt            []byte
-	ServerPublicKey []byte
+	Ciphertext      []byte `json:"ciphertext"`
+	Salt            []byte `json:"salt"`
+	ServerPublicKey []byte `json:"serverPublicKey"`
+	// Encoding is the content encoding that produced the ciphertext. It decides
+	// which HTTP headers are needed to deliver the message.
+	Encoding ContentEncoding `json:"encoding"`
+}
+
+// UnmarshalJSON decodes an EncryptionResult. The encoding must be given, as
+// the ciphertext can't be delivered without knowing it.
+func (r *EncryptionResult) UnmarshalJSON(b []byte) error {
+	// A type without this method, so that decoding it doesn't recurse.
+	type encryptionResultJSON EncryptionResult
+	var v struct {
+		encryptionResultJSON
+		Encoding *ContentEncoding `json:"encoding"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	if v.Encoding == nil {
+		return errors.New("encryption result has no encoding")
+	}
+	*r = EncryptionResult(v.encryptionResultJSON)
+	r.Encoding = *v.Encoding
+	return nil
 }
 
 // Encrypt a message such that it can be sent using the Web Push protocol.
@@ -174,7 +306,22 @@ type EncryptionResult struct {
 //    - https://tools.ietf.org/html/draft-ietf-httpbis-encryption-encoding
 //    - https://en.wikipedia.org/wiki/Elliptic_curve_Diffie%E2%80%93Hellman
 //    - https://tools.ietf.org/html/draft-ietf-webpush-encryption
+// Messages longer than MaxPayloadLength(encoding) return a
+// *PayloadTooLargeError.
 func Encrypt(sub *Subscription, message string, encoding ContentEncoding) (*EncryptionResult, error) {
+	plaintext := []byte(message)
+
+	if max := MaxPayloadLength(encoding); len(plaintext) > max {
+		return nil, &PayloadTooLargeError{len(plaintext), max}
+	}
+
+	return seal(sub, plaintext, encoding)
+}
+
+// seal encrypts the plaintext for the subscription. Any length is allowed, as
+// aes128gcm splits it into as many records as it needs, but push services only
+// accept messages as long as MaxPayloadLength.
+func seal(sub *Subscription, plaintext []byte, encoding ContentEncoding) (*EncryptionResult, error) {
 	// sub.Key is the p256dh key.
 	if len(sub.Key) == 0 {
 		return nil, errors.New("Subscription must include the client's public key")
@@ -185,17 +332,6 @@ func Encrypt(sub *Subscription, message string, encoding ContentEncoding) (*Encr
 		return nil, errors.New("Subscription must include the client's auth value")
 	}
 
-	plaintext := []byte(message)
-
-	maxPayloadLength := aes128gcmMaxPayloadLength
-	if encoding == AESGCM {
-		maxPayloadLength = aesgcmMaxPayloadLength
-	}
-
-	if n := len(plaintext); n > maxPayloadLength {
-		return nil, fmt.Errorf("Payload is too large. The max number of bytes is %d, input is %d bytes.", maxPayloadLength, n)
-	}
-
 	salt, err := randomSalt()
 	if err != nil {
 		return nil, err
@@ -213,26 +349,27 @@ func Encrypt(sub *Subscription, message string, encoding ContentEncoding) (*Encr
 		return nil, err
 	}
 
-	// Derive a Pseudo-Random Key (prk) that can be used to further derive our
-	// other encryption parameters.
-	var prk []byte
-	if encoding == AESGCM {
-		// aesgcm derivations are described in
-		// https://tools.ietf.org/html/draft-ietf-httpbis-encryption-encoding-00
-		prk = hkdf(sub.Auth, secret, authInfo, 32)
-	} else {
+	if encoding == AES128GCM {
 		// aes128gcm derivations are described in
-		// https://tools.ietf.org/html/draft-ietf-httpbis-encryption-encoding-06
+		// https://tools.ietf.org/html/rfc8291#section-3.4. The derived key is the
+		// input keying material for the RFC 8188 content coding, which uses the
+		// server public key as its key id.
 		keyInfo := newKeyInfo(sub.Key, serverPublicKey)
-		prk = hkdf(sub.Auth, secret, keyInfo, 32)
+		ikm := hkdf(sub.Auth, secret, keyInfo, 32)
+		ciphertext, err := ece.Encrypt(plaintext, ikm, salt, maxPayloadRecordSize, serverPublicKey)
+		if err != nil {
+			return nil, err
+		}
+		return &EncryptionResult{ciphertext, salt, serverPublicKey, encoding}, nil
 	}
 
+	// Derive a Pseudo-Random Key (prk) that can be used to further derive our
+	// other encryption parameters. aesgcm derivations are described in
+	// https://tools.ietf.org/html/draft-ietf-httpbis-encryption-encoding-00
+	prk := hkdf(sub.Auth, secret, authInfo, 32)
+
 	// Derive the Content Encryption Key and nonce
-	// Context is only needed for aesgcm
-	var ctx []byte
-	if encoding == AESGCM {
-		ctx = newContext(sub.Key, serverPublicKey)
-	}
+	ctx := newContext(sub.Key, serverPublicKey)
 	cek, err := newCEK(ctx, salt, prk, encoding)
 	if err != nil {
 		return nil, err
@@ -240,22 +377,20 @@ func Encrypt(sub *Subscription, message string, encoding ContentEncoding) (*Encr
 	nonce := newNonce(ctx, salt, prk)
 
 	// Do the actual encryption
-	ciphertext, err := encrypt(plaintext, cek, nonce, encoding)
+	ciphertext, err := encrypt(plaintext, cek, nonce)
 	if err != nil {
 		return nil, err
 	}
 
-	if encoding == AES128GCM {
-		ciphertext = appendHeader(salt, serverPublicKey, ciphertext)
-	}
-
 	// Return all of the values needed to construct a Web Push HTTP request.
-	return &EncryptionResult{ciphertext, salt, serverPublicKey}, nil
+	return &EncryptionResult{ciphertext, salt, serverPublicKey, encoding}, nil
 }
 
+// newCEK derives the content encryption key for aesgcm. Keys for aes128gcm are
+// derived by the ece package instead.
 func newCEK(ctx, salt, prk []byte, encoding ContentEncoding) ([]byte, error) {
-	if encoding != AESGCM && encoding != AES128GCM {
-		return []byte{}, fmt.Errorf("Content Encoding is not recognized, you must use either AESGCM or AES128GCM.")
+	if encoding != AESGCM {
+		return nil, fmt.Errorf("cannot derive an aesgcm key for content encoding %v", encoding)
 	}
 	info := newInfo(encoding.String(), ctx)
 	return hkdf(salt, prk, info, 16), nil
@@ -319,25 +454,6 @@ func newKeyInfo(subscriptionPublicKey, serverPublicKey []byte) []byte {
 	return info
 }
 
-// Returns an 86 octet header. See section 2.1 of:
-// https://tools.ietf.org/html/draft-ietf-httpbis-encryption-encoding-06#section-2.1
-func appendHeader(salt, serverPublicKey, ciphertext []byte) []byte {
-	var result []byte
-	// A push service is not required to support more than 4096 octets of
-	// payload body so the record size can be at most 4096.
-	rsbuf := make([]byte, 4)
-	binary.BigEndian.PutUint32(rsbuf, uint32(maxPayloadRecordSize))
-	idlen := uint8(len(serverPublicKey))
-
-	result = append(result, salt...)
-	result = append(result, rsbuf...)
-	result = append(result, byte(idlen))
-	result = append(result, serverPublicKey...)
-	result = append(result, ciphertext...)
-
-	return result
-}
-
 // HMAC-based Extract-and-Expand Key Derivation Function (HKDF)
 //
 // This is used to derive a secure encryption key from a mostly-secure shared
@@ -368,21 +484,12 @@ func hkdf(salt, ikm, info []byte, length int) []byte {
 }
 
 // Encrypt the plaintext message using AES128/GCM
-func encrypt(plaintext, key, nonce []byte, encoding ContentEncoding) ([]byte, error) {
-	var data []byte
-	if encoding == AES128GCM {
-		// The padding delimiter octet MUST be checked, values other than 0x02 MUST
-		// cause the message to be discarded.
-		// See here for more details for restrictions on use of "aes128gcm":
-		// https://tools.ietf.org/html/draft-ietf-webpush-encryption-08#section-4
-		data = append(plaintext, []byte{0x02}...)
-	} else {
-		// Add padding. There is a uint16 size followed by that number of bytes of
-		// padding.
-		// TODO: Right now we leave the size at zero. We should add a padding option
-		// that allows the payload size to be obscured.
-		data = append([]byte{0, 0}, plaintext...)
-	}
+func encrypt(plaintext, key, nonce []byte) ([]byte, error) {
+	// Add padding. There is a uint16 size followed by that number of bytes of
+	// padding.
+	// TODO: Right now we leave the size at zero. We should add a padding option
+	// that allows the payload size to be obscured.
+	data := append([]byte{0, 0}, plaintext...)
 	c, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
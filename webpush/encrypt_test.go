@@ -19,6 +19,7 @@ import (
 	"crypto/elliptic"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"strings"
 	"testing"
 )
@@ -111,6 +112,78 @@ func TestSubscriptionFromJSON(t *testing.T) {
 	}
 }
 
+func TestSubscriptionJSONRoundTrip(t *testing.T) {
+	sub, err := SubscriptionFromJSON(subscriptionJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := json.Marshal(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"endpoint":"https://example.com/","keys":{"p256dh":"BCXJI0VW7evda9ldlo18MuHhgQVxWbd0dGmUfpQedaD7KDjB8sGWX5iiP7lkjxi-A02b8Fi3BMWWLoo3b4Tdl-c","auth":"WPF9D0bTVZCV2pXSgj6Zug"}}`
+	if string(b) != expected {
+		t.Errorf("Marshaled subscription was %s, expected %s", b, expected)
+	}
+
+	decoded, err := SubscriptionFromJSON(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Endpoint != sub.Endpoint || !bytes.Equal(decoded.Key, sub.Key) || !bytes.Equal(decoded.Auth, sub.Auth) {
+		t.Errorf("Decoded subscription %v does not match %v", decoded, sub)
+	}
+}
+
+func TestSubscriptionLegacyJSON(t *testing.T) {
+	sub, err := SubscriptionFromJSON(subscriptionJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The encoding/json default, as used to store subscriptions before
+	// Subscription had a MarshalJSON method.
+	legacy, err := json.Marshal(struct {
+		Endpoint  string
+		Key, Auth []byte
+	}{sub.Endpoint, sub.Key, sub.Auth})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := SubscriptionFromJSON(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Endpoint != sub.Endpoint || !bytes.Equal(decoded.Key, sub.Key) || !bytes.Equal(decoded.Auth, sub.Auth) {
+		t.Errorf("Decoded subscription %v does not match %v", decoded, sub)
+	}
+
+	b, err := json.Marshal(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := SubscriptionFromJSON(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Endpoint != sub.Endpoint || !bytes.Equal(again.Key, sub.Key) || !bytes.Equal(again.Auth, sub.Auth) {
+		t.Errorf("Re-encoded subscription %v does not match %v", again, sub)
+	}
+
+	if _, err := SubscriptionFromJSON([]byte(`{"Endpoint": "https://example.com/", "Key": "AAAA"}`)); err == nil {
+		t.Error("Expected an error for a legacy subscription without an auth secret")
+	}
+
+	keyless, err := SubscriptionFromJSON([]byte(`{"endpoint": "https://example.com/"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyless.Endpoint != "https://example.com/" || len(keyless.Key) != 0 || len(keyless.Auth) != 0 {
+		t.Errorf("Unexpected keyless subscription %v", keyless)
+	}
+}
+
 func TestEncrypt(t *testing.T) {
 	sub, err := SubscriptionFromJSON(subscriptionJSON)
 	if err != nil {
@@ -172,6 +245,47 @@ func TestEncrypt(t *testing.T) {
 	}
 }
 
+func TestEncryptionResultJSON(t *testing.T) {
+	sub, err := SubscriptionFromJSON(subscriptionJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, encoding := range []ContentEncoding{AESGCM, AES128GCM} {
+		result, err := Encrypt(sub, message, encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := json.Marshal(result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded EncryptionResult
+		if err := json.Unmarshal(b, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if decoded.Encoding != encoding {
+			t.Errorf("Encoding was %v, expected %v", decoded.Encoding, encoding)
+		}
+		if !bytes.Equal(decoded.Ciphertext, result.Ciphertext) ||
+			!bytes.Equal(decoded.Salt, result.Salt) ||
+			!bytes.Equal(decoded.ServerPublicKey, result.ServerPublicKey) {
+			t.Errorf("Decoded result %v does not match %v", decoded, result)
+		}
+	}
+
+	var decoded EncryptionResult
+	if err := json.Unmarshal([]byte(`{"encoding": "gzip"}`), &decoded); err == nil {
+		t.Error("Expected an error due to unknown encoding")
+	}
+	if err := json.Unmarshal([]byte(`{"ciphertext": "AAAA", "salt": "AAAA", "serverPublicKey": "AAAA"}`), &decoded); err == nil {
+		t.Error("Expected an error due to missing encoding")
+	}
+	if err := json.Unmarshal([]byte(`{"encoding": null}`), &decoded); err == nil {
+		t.Error("Expected an error due to null encoding")
+	}
+}
+
 func rfcAESgcmSalt() ([]byte, error) {
 	return base64.URLEncoding.WithPadding(base64.NoPadding).DecodeString("lngarbyKfMoi9Z75xYXmkg")
 }
@@ -274,3 +388,10 @@ func TestSharedSecret(t *testing.T) {
 		t.Error("Expected an error due to nil key")
 	}
 }
+
+func TestNewCEKEncoding(t *testing.T) {
+	_, err := newCEK(nil, nil, nil, AES128GCM)
+	if err == nil || !strings.Contains(err.Error(), "aes128gcm") {
+		t.Errorf("Expected an error naming aes128gcm, got %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webpush
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// EndpointPolicy checks a push request before it is signed and sent. It may
+// rewrite req.URL, add headers, or return an error to refuse to send to the
+// endpoint. Endpoints come from browsers, so an application server that sends
+// to any endpoint it is given can be made to POST to arbitrary URLs; use
+// AllowHosts to restrict them to known push services.
+type EndpointPolicy interface {
+	CheckEndpoint(req *http.Request) error
+}
+
+// EndpointPolicyFunc is a function that implements EndpointPolicy.
+type EndpointPolicyFunc func(req *http.Request) error
+
+// CheckEndpoint calls f(req).
+func (f EndpointPolicyFunc) CheckEndpoint(req *http.Request) error {
+	return f(req)
+}
+
+// EndpointError is returned when an EndpointPolicy refuses an endpoint.
+type EndpointError struct {
+	Endpoint string
+	Reason   string
+}
+
+func (e *EndpointError) Error() string {
+	return fmt.Sprintf("endpoint %s refused: %s", e.Endpoint, e.Reason)
+}
+
+// The hosts of Google Cloud Messaging, which stopped accepting messages in
+// 2019. Chrome subscriptions now use fcm.googleapis.com.
+var legacyGCMHosts = []string{"android.googleapis.com", "gcm-http.googleapis.com"}
+
+// DefaultEndpointPolicy is used when Options.EndpointPolicy is nil. It refuses
+// the endpoints of the shut down Google Cloud Messaging service, as those
+// subscriptions can't receive messages any more and should be deleted.
+var DefaultEndpointPolicy EndpointPolicy = EndpointPolicyFunc(checkLegacyGCM)
+
+func checkLegacyGCM(req *http.Request) error {
+	host, _ := splitHost(req.URL)
+	for _, h := range legacyGCMHosts {
+		if host == h {
+			return &EndpointError{req.URL.String(), "Google Cloud Messaging is no longer supported"}
+		}
+	}
+	return nil
+}
+
+// AllowHosts returns an EndpointPolicy that only allows https endpoints on the
+// given hosts, such as "fcm.googleapis.com". A host starting with "*." also
+// matches any of its subdomains, such as "*.push.services.mozilla.com".
+// Endpoints with user information or a port are refused.
+func AllowHosts(hosts ...string) EndpointPolicy {
+	return EndpointPolicyFunc(func(req *http.Request) error {
+		u := req.URL
+		if u.Scheme != "https" {
+			return &EndpointError{u.String(), "endpoint is not https"}
+		}
+		host, port := splitHost(u)
+		if u.User != nil || port != "" {
+			return &EndpointError{u.String(), "endpoint has user information or a port"}
+		}
+		for _, h := range hosts {
+			if matchHost(host, h) {
+				return nil
+			}
+		}
+		return &EndpointError{u.String(), "host is not an allowed push service"}
+	})
+}
+
+// splitHost returns the lower case host name and the port of the URL.
+func splitHost(u *url.URL) (host, port string) {
+	host = u.Host
+	if i := strings.LastIndex(host, ":"); i > strings.LastIndex(host, "]") {
+		if h, p, err := net.SplitHostPort(host); err == nil {
+			host, port = h, p
+		}
+	}
+	return strings.ToLower(strings.Trim(host, "[]")), port
+}
+
+// matchHost reports whether a lower case host matches the pattern, which
+// matches any subdomain if it starts with "*.".
+func matchHost(host, pattern string) bool {
+	pattern = strings.ToLower(pattern)
+	return host == pattern || strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:])
+}
@@ -0,0 +1,95 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webpush
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestDefaultEndpointPolicy(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		allowed  bool
+	}{
+		{"https://android.googleapis.com/gcm/send/abc", false},
+		{"https://gcm-http.googleapis.com/gcm/abc", false},
+		{"https://ANDROID.googleapis.com:443/gcm/send/abc", false},
+		{"https://fcm.googleapis.com/fcm/send/abc", true},
+		{"http://localhost:8080/push/abc", true},
+	}
+	for _, test := range tests {
+		_, err := NewPushRequestWithOptions(&Subscription{Endpoint: test.endpoint}, "", nil)
+		if test.allowed && err != nil {
+			t.Errorf("%s: expected no error, got %v", test.endpoint, err)
+		}
+		if _, ok := err.(*EndpointError); !test.allowed && !ok {
+			t.Errorf("%s: expected an *EndpointError, got %v", test.endpoint, err)
+		}
+	}
+}
+
+func TestAllowHosts(t *testing.T) {
+	policy := AllowHosts("fcm.googleapis.com", "*.push.services.mozilla.com")
+	tests := []struct {
+		endpoint string
+		allowed  bool
+	}{
+		{"https://fcm.googleapis.com/fcm/send/abc", true},
+		{"https://updates.push.services.mozilla.com/wpush/v2/abc", true},
+		{"https://push.services.mozilla.com/wpush/v2/abc", false},
+		{"https://evilpush.services.mozilla.com/wpush/v2/abc", false},
+		{"http://fcm.googleapis.com/fcm/send/abc", false},
+		{"https://fcm.googleapis.com:8443/fcm/send/abc", false},
+		{"https://user@fcm.googleapis.com/fcm/send/abc", false},
+		{"https://169.254.169.254/latest/meta-data", false},
+		{"https://fcm.googleapis.com.example.com/abc", false},
+	}
+	for _, test := range tests {
+		_, err := NewPushRequestWithOptions(&Subscription{Endpoint: test.endpoint}, "", &Options{EndpointPolicy: policy})
+		if test.allowed && err != nil {
+			t.Errorf("%s: expected no error, got %v", test.endpoint, err)
+		}
+		if _, ok := err.(*EndpointError); !test.allowed && !ok {
+			t.Errorf("%s: expected an *EndpointError, got %v", test.endpoint, err)
+		}
+	}
+}
+
+func TestEndpointPolicyRewrite(t *testing.T) {
+	v := newTestVAPID(t)
+	policy := EndpointPolicyFunc(func(req *http.Request) error {
+		req.URL.Host = "push.example.net"
+		req.Header.Set("X-Checked", "1")
+		return nil
+	})
+	sub := &Subscription{Endpoint: "https://old.example.net/push/abc"}
+	req, err := NewPushRequestWithOptions(sub, "", &Options{VAPID: v, EndpointPolicy: policy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.URL.String() != "https://push.example.net/push/abc" {
+		t.Errorf("Expected the endpoint to be rewritten, got %v", req.URL)
+	}
+	if req.Host != "push.example.net" {
+		t.Errorf("Expected the Host header to follow the rewrite, got %v", req.Host)
+	}
+	if req.Header.Get("X-Checked") != "1" {
+		t.Error("Expected the header added by the policy")
+	}
+	if _, err := VerifyVAPID(req); err != nil {
+		t.Errorf("Expected the token to be for the rewritten origin, got %v", err)
+	}
+}
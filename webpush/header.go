@@ -0,0 +1,126 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webpush
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/googlechrome/push-encryption-go/ece"
+)
+
+const (
+	// The header is salt (16) || rs (4) || idlen (1) || keyid (idlen)
+	aes128gcmHeaderPrefixLength = ece.SaltSize + 4 + 1
+	// The size of the AES-GCM authentication tag at the end of each record.
+	gcmTagSize = 16
+)
+
+// AES128GCMHeader is the header at the start of a message encrypted with
+// AES128GCM, along with the encrypted records that follow it. See section 2.1
+// of https://tools.ietf.org/html/rfc8188.
+type AES128GCMHeader struct {
+	Salt       []byte
+	RecordSize uint32
+	// KeyID is the server public key for Web Push messages.
+	KeyID []byte
+	// Ciphertext is the encrypted records following the header.
+	Ciphertext []byte
+}
+
+// ParseAES128GCMHeader is the inverse of the header written by Encrypt. It
+// returns an error if the header is malformed, but a message that parses can
+// still be one a browser will drop. Problems lists those reasons, and String
+// includes them in a human-readable dump of the header.
+func ParseAES128GCMHeader(b []byte) (*AES128GCMHeader, error) {
+	if len(b) < aes128gcmHeaderPrefixLength {
+		return nil, fmt.Errorf("message is %d bytes, shorter than the %d byte header", len(b), aes128gcmHeaderPrefixLength)
+	}
+
+	rs := binary.BigEndian.Uint32(b[ece.SaltSize:])
+	if rs < ece.MinRecordSize {
+		return nil, fmt.Errorf("record size %d is less than the minimum of %d", rs, ece.MinRecordSize)
+	}
+
+	idlen := int(b[ece.SaltSize+4])
+	rest := b[aes128gcmHeaderPrefixLength:]
+	if idlen > len(rest) {
+		return nil, fmt.Errorf("key id length %d is longer than the %d bytes after the header", idlen, len(rest))
+	}
+
+	return &AES128GCMHeader{
+		Salt:       b[:ece.SaltSize],
+		RecordSize: rs,
+		KeyID:      rest[:idlen],
+		Ciphertext: rest[idlen:],
+	}, nil
+}
+
+// Records returns the number of records in the ciphertext, or 0 if the record
+// size is too small to hold any.
+func (h *AES128GCMHeader) Records() int {
+	if h.RecordSize < ece.MinRecordSize {
+		return 0
+	}
+	return (len(h.Ciphertext) + int(h.RecordSize) - 1) / int(h.RecordSize)
+}
+
+// Problems returns the reasons a push service or browser would reject the
+// message, or nil if the header looks valid for Web Push.
+func (h *AES128GCMHeader) Problems() []string {
+	var problems []string
+	if len(h.KeyID) != 65 {
+		problems = append(problems, fmt.Sprintf("key id is %d bytes, Web Push requires the 65 byte server public key", len(h.KeyID)))
+	} else if x, _ := elliptic.Unmarshal(curve, h.KeyID); x == nil {
+		problems = append(problems, "key id is not a valid P-256 public key")
+	}
+	if h.RecordSize < ece.MinRecordSize {
+		problems = append(problems, fmt.Sprintf("record size %d is less than the minimum of %d", h.RecordSize, ece.MinRecordSize))
+	} else if h.RecordSize > maxPayloadRecordSize {
+		problems = append(problems, fmt.Sprintf("record size %d is larger than the %d bytes push services must accept", h.RecordSize, maxPayloadRecordSize))
+	}
+	switch {
+	case len(h.Ciphertext) < gcmTagSize+1:
+		problems = append(problems, fmt.Sprintf("ciphertext is %d bytes, too short to hold a record", len(h.Ciphertext)))
+	case h.Records() > 1:
+		problems = append(problems, fmt.Sprintf("ciphertext is %d records, Web Push requires a single record", h.Records()))
+	}
+	if n := aes128gcmHeaderPrefixLength + len(h.KeyID) + len(h.Ciphertext); n > maxPayloadRecordSize {
+		problems = append(problems, fmt.Sprintf("message is %d bytes, larger than the %d bytes push services must accept", n, maxPayloadRecordSize))
+	}
+	return problems
+}
+
+// String returns a human-readable dump of the header, for debugging.
+func (h *AES128GCMHeader) String() string {
+	b64 := base64.URLEncoding.WithPadding(base64.NoPadding)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "aes128gcm header\n")
+	fmt.Fprintf(&buf, "  salt:        %s (%d bytes)\n", b64.EncodeToString(h.Salt), len(h.Salt))
+	fmt.Fprintf(&buf, "  record size: %d\n", h.RecordSize)
+	fmt.Fprintf(&buf, "  key id:      %s (%d bytes)\n", b64.EncodeToString(h.KeyID), len(h.KeyID))
+	fmt.Fprintf(&buf, "  ciphertext:  %d bytes in %d record(s)\n", len(h.Ciphertext), h.Records())
+	if problems := h.Problems(); len(problems) > 0 {
+		fmt.Fprintf(&buf, "  problems:\n")
+		for _, p := range problems {
+			fmt.Fprintf(&buf, "    - %s\n", p)
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,92 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webpush
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestParseAES128GCMHeader(t *testing.T) {
+	b64 := base64.URLEncoding.WithPadding(base64.NoPadding)
+	content, err := b64.DecodeString(rfcAES128gcmCipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := ParseAES128GCMHeader(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt, _ := rfcAES128gcmSalt()
+	if !bytes.Equal(h.Salt, salt) {
+		t.Errorf("Salt was %v, expected %v", h.Salt, salt)
+	}
+	if h.RecordSize != 4096 {
+		t.Errorf("Record size was %d, expected 4096", h.RecordSize)
+	}
+	_, pub, _ := rfcAES128gcmKeys()
+	if !bytes.Equal(h.KeyID, pub) {
+		t.Errorf("Key id was %v, expected %v", h.KeyID, pub)
+	}
+	if len(h.Ciphertext) != len(content)-86 {
+		t.Errorf("Ciphertext was %d bytes, expected %d", len(h.Ciphertext), len(content)-86)
+	}
+	if p := h.Problems(); p != nil {
+		t.Errorf("Expected no problems, got %v", p)
+	}
+	if s := h.String(); !strings.Contains(s, "record size: 4096") || strings.Contains(s, "problems") {
+		t.Errorf("Unexpected dump %s", s)
+	}
+
+	// A key id that isn't a public key and two records
+	bad := append([]byte{}, content[:16]...)
+	bad = append(bad, 0, 0, 0, 20, 2, 'i', 'd')
+	bad = append(bad, make([]byte, 30)...)
+	h, err = ParseAES128GCMHeader(bad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Problems()) != 2 {
+		t.Errorf("Expected two problems, got %v", h.Problems())
+	}
+	if !strings.Contains(h.String(), "Web Push requires a single record") {
+		t.Errorf("Expected dump to list problems, got %s", h.String())
+	}
+
+	if _, err := ParseAES128GCMHeader(content[:20]); err == nil {
+		t.Error("Expected an error due to short header")
+	}
+	short := append([]byte{}, content[:21]...)
+	if _, err := ParseAES128GCMHeader(short); err == nil {
+		t.Error("Expected an error due to key id longer than the message")
+	}
+	small := append([]byte{}, content...)
+	copy(small[16:20], []byte{0, 0, 0, 17})
+	if _, err := ParseAES128GCMHeader(small); err == nil {
+		t.Error("Expected an error due to small record size")
+	}
+
+	// A header built by hand can have any record size.
+	zero := &AES128GCMHeader{Salt: salt, KeyID: pub, Ciphertext: h.Ciphertext}
+	if zero.Records() != 0 {
+		t.Errorf("Expected no records with a zero record size, got %d", zero.Records())
+	}
+	if !strings.Contains(zero.String(), "record size 0 is less than the minimum") {
+		t.Errorf("Expected dump to report the record size, got %s", zero.String())
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.18
+// +build go1.18
+
+package webpush
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// JSONError is returned by the JSON helpers when a value can't be encoded or
+// decoded, as distinct from errors encrypting, decrypting or sending it.
+type JSONError struct {
+	Err error
+}
+
+func (e *JSONError) Error() string {
+	return "web push payload: " + e.Err.Error()
+}
+
+// EncryptJSON encrypts the JSON encoding of v. As with Encrypt, a
+// *PayloadTooLargeError is returned if the encoding is too long.
+func EncryptJSON[T any](sub *Subscription, v T, encoding ContentEncoding) (*EncryptionResult, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, &JSONError{err}
+	}
+	return Encrypt(sub, string(b), encoding)
+}
+
+// SendJSON sends the JSON encoding of v, as SendWithOptions does. A
+// *PayloadTooLargeError is returned if the encoding is too long.
+func SendJSON[T any](client *http.Client, sub *Subscription, v T, opts *Options) (*Result, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, &JSONError{err}
+	}
+	return SendWithOptions(client, sub, string(b), opts)
+}
+
+// DecryptJSON decrypts a message, as Decrypt does, and decodes it from JSON.
+func DecryptJSON[T any](sub *Subscription, priv []byte, result *EncryptionResult) (T, error) {
+	var v T
+	b, err := Decrypt(sub, priv, result)
+	if err != nil {
+		return v, err
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return v, &JSONError{err}
+	}
+	return v, nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.18
+// +build go1.18
+
+package webpush
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type chatMessage struct {
+	From string `json:"from"`
+	Text string `json:"text"`
+}
+
+func TestEncryptJSON(t *testing.T) {
+	sub, priv := newTestKeys(t)
+	for _, encoding := range []ContentEncoding{AESGCM, AES128GCM} {
+		result, err := EncryptJSON(sub, chatMessage{"alice", "Hello"}, encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := DecryptJSON[chatMessage](sub, priv, result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.From != "alice" || m.Text != "Hello" {
+			t.Errorf("%v: unexpected message %+v", encoding, m)
+		}
+	}
+}
+
+func TestJSONErrors(t *testing.T) {
+	sub, priv := newTestKeys(t)
+
+	_, err := EncryptJSON(sub, make(chan int), AES128GCM)
+	if _, ok := err.(*JSONError); !ok {
+		t.Errorf("Expected a *JSONError for an unencodable value, got %v", err)
+	}
+
+	_, err = EncryptJSON(sub, chatMessage{"alice", strings.Repeat("a", 4100)}, AES128GCM)
+	if _, ok := err.(*PayloadTooLargeError); !ok {
+		t.Errorf("Expected a *PayloadTooLargeError, got %v", err)
+	}
+
+	result, err := Encrypt(sub, "not JSON", AES128GCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecryptJSON[chatMessage](sub, priv, result); err == nil {
+		t.Error("Expected an error decoding a payload that isn't JSON")
+	} else if _, ok := err.(*JSONError); !ok {
+		t.Errorf("Expected a *JSONError, got %v", err)
+	}
+
+	other, otherPriv := newTestKeys(t)
+	if _, err := DecryptJSON[chatMessage](other, otherPriv, result); err == nil {
+		t.Error("Expected an error decrypting with the wrong keys")
+	} else if _, ok := err.(*JSONError); ok {
+		t.Error("Expected a decryption error, not a *JSONError")
+	}
+}
+
+func TestSendJSON(t *testing.T) {
+	var received []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer ts.Close()
+
+	sub, _ := newTestKeys(t)
+	sub.Endpoint = ts.URL
+	result, err := SendJSON(nil, sub, chatMessage{"alice", "Hello"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.StatusCode != http.StatusCreated || len(received) == 0 {
+		t.Errorf("Expected the message to be sent, got %d with %d bytes", result.StatusCode, len(received))
+	}
+
+	if _, err := SendJSON(nil, sub, func() {}, nil); err == nil {
+		t.Error("Expected an error for an unencodable value")
+	} else if _, ok := err.(*JSONError); !ok {
+		t.Errorf("Expected a *JSONError, got %v", err)
+	}
+}
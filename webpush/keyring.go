@@ -0,0 +1,125 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webpush
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+)
+
+// VAPIDKeyRing holds the VAPID keys of an application server while it moves
+// from one key to another. A push service only accepts messages signed with
+// the applicationServerKey that a subscription was created with, so messages
+// to older subscriptions must keep being signed with retired keys until the
+// page resubscribes them with the current key.
+//
+// Record the key each subscription was created with in its
+// ApplicationServerKey field, and set Options.VAPIDKeys to sign requests with
+// the matching key.
+type VAPIDKeyRing struct {
+	// Current is given to browsers as the applicationServerKey of new
+	// subscriptions.
+	Current *VAPID
+	// Retired are earlier keys that still have subscriptions.
+	Retired []*VAPID
+}
+
+// ErrUnknownVAPIDKey is returned when a subscription was created with a key
+// that isn't in the key ring.
+var ErrUnknownVAPIDKey = errors.New("subscription was created with an unknown VAPID key")
+
+// ApplicationServerKey returns the public key that browsers should be given
+// for new subscriptions.
+func (r *VAPIDKeyRing) ApplicationServerKey() []byte {
+	if r.Current == nil {
+		return nil
+	}
+	return r.Current.PublicKey()
+}
+
+// Key returns the VAPID that messages to the subscription must be signed
+// with. Subscriptions that don't record an ApplicationServerKey are assumed to
+// use the current key.
+func (r *VAPIDKeyRing) Key(sub *Subscription) (*VAPID, error) {
+	if len(sub.ApplicationServerKey) == 0 {
+		if r.Current == nil {
+			return nil, errors.New("VAPID key ring has no current key")
+		}
+		return r.Current, nil
+	}
+	if v, _ := r.find(sub.ApplicationServerKey); v != nil {
+		return v, nil
+	}
+	return nil, ErrUnknownVAPIDKey
+}
+
+// find returns the key with the given public key, and whether it is retired.
+func (r *VAPIDKeyRing) find(pub []byte) (*VAPID, bool) {
+	if r.Current != nil && bytes.Equal(r.Current.PublicKey(), pub) {
+		return r.Current, false
+	}
+	for _, v := range r.Retired {
+		if bytes.Equal(v.PublicKey(), pub) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// MigrationReport lists the subscriptions that haven't moved to the current
+// key of a VAPIDKeyRing.
+type MigrationReport struct {
+	// Current is the number of subscriptions that use the current key.
+	Current int
+	// Unrecorded are the subscriptions that don't record which key they were
+	// created with. Messages to them are signed with the current key.
+	Unrecorded []*Subscription
+	// Retired maps the URL-safe base64 encoding of each retired public key to
+	// the subscriptions that still use it.
+	Retired map[string][]*Subscription
+	// Unknown are the subscriptions created with a key that isn't in the key
+	// ring. Messages can't be sent to them.
+	Unknown []*Subscription
+}
+
+// Done reports whether every subscription uses the current key, so that the
+// retired keys can be thrown away.
+func (m *MigrationReport) Done() bool {
+	return len(m.Unrecorded) == 0 && len(m.Retired) == 0 && len(m.Unknown) == 0
+}
+
+// MigrationReport sorts the stored subscriptions by the key that they were
+// created with.
+func (r *VAPIDKeyRing) MigrationReport(subs []*Subscription) *MigrationReport {
+	report := &MigrationReport{Retired: make(map[string][]*Subscription)}
+	for _, sub := range subs {
+		if len(sub.ApplicationServerKey) == 0 {
+			report.Unrecorded = append(report.Unrecorded, sub)
+			continue
+		}
+		v, retired := r.find(sub.ApplicationServerKey)
+		switch {
+		case v == nil:
+			report.Unknown = append(report.Unknown, sub)
+		case retired:
+			k := base64.RawURLEncoding.EncodeToString(sub.ApplicationServerKey)
+			report.Retired[k] = append(report.Retired[k], sub)
+		default:
+			report.Current++
+		}
+	}
+	return report
+}
@@ -0,0 +1,111 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webpush
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+)
+
+func newTestVAPID(t *testing.T) *VAPID {
+	key, err := GenerateVAPIDKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &VAPID{PrivateKey: key, Subject: "mailto:push@example.com"}
+}
+
+func TestVAPIDKeyRing(t *testing.T) {
+	current, retired, unknown := newTestVAPID(t), newTestVAPID(t), newTestVAPID(t)
+	ring := &VAPIDKeyRing{Current: current, Retired: []*VAPID{retired}}
+
+	if !bytes.Equal(ring.ApplicationServerKey(), current.PublicKey()) {
+		t.Error("Expected the current key to be given to new subscriptions")
+	}
+
+	endpoint := "https://push.example.net/push/a"
+	subs := []*Subscription{
+		{Endpoint: endpoint, ApplicationServerKey: current.PublicKey()},
+		{Endpoint: endpoint, ApplicationServerKey: retired.PublicKey()},
+		{Endpoint: endpoint},
+		{Endpoint: endpoint, ApplicationServerKey: unknown.PublicKey()},
+	}
+	for i, want := range []*VAPID{current, retired, current} {
+		req, err := NewPushRequestWithOptions(subs[i], "", &Options{VAPIDKeys: ring})
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims, err := VerifyVAPID(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(claims.PublicKey, want.PublicKey()) {
+			t.Errorf("Subscription %d was signed with the wrong key", i)
+		}
+	}
+	if _, err := NewPushRequestWithOptions(subs[3], "", &Options{VAPIDKeys: ring}); err != ErrUnknownVAPIDKey {
+		t.Errorf("Expected ErrUnknownVAPIDKey, got %v", err)
+	}
+	if _, err := NewPushRequestWithOptions(subs[0], "", &Options{VAPIDKeys: ring, VAPID: current}); err == nil {
+		t.Error("Expected an error using both VAPID and VAPIDKeys")
+	}
+
+	report := ring.MigrationReport(subs)
+	if report.Current != 1 {
+		t.Errorf("Expected 1 subscription on the current key, got %d", report.Current)
+	}
+	k := base64.RawURLEncoding.EncodeToString(retired.PublicKey())
+	if len(report.Retired) != 1 || len(report.Retired[k]) != 1 || report.Retired[k][0] != subs[1] {
+		t.Errorf("Expected the second subscription on the retired key, got %v", report.Retired)
+	}
+	if len(report.Unrecorded) != 1 || report.Unrecorded[0] != subs[2] {
+		t.Errorf("Expected the third subscription to be unrecorded, got %v", report.Unrecorded)
+	}
+	if len(report.Unknown) != 1 || report.Unknown[0] != subs[3] {
+		t.Errorf("Expected the fourth subscription to be unknown, got %v", report.Unknown)
+	}
+	if report.Done() {
+		t.Error("Expected the migration not to be done")
+	}
+	if !ring.MigrationReport(subs[:1]).Done() {
+		t.Error("Expected the migration to be done")
+	}
+}
+
+func TestSubscriptionApplicationServerKeyJSON(t *testing.T) {
+	v := newTestVAPID(t)
+	sub, err := SubscriptionFromJSON(subscriptionJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.ApplicationServerKey != nil {
+		t.Error("Expected no application server key")
+	}
+
+	sub.ApplicationServerKey = v.PublicKey()
+	b, err := json.Marshal(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := SubscriptionFromJSON(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded.ApplicationServerKey, v.PublicKey()) {
+		t.Error("Application server key did not survive the round trip")
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webpush
+
+import (
+	"fmt"
+	"strings"
+)
+
+// NotificationCatalog holds the translations of a notification, keyed by BCP
+// 47 language tag, such as "en", "pt-BR" or "zh-Hant".
+//
+// A translation is chosen for a locale as in RFC 4647 lookup: the locale is
+// tried, then it is shortened a subtag at a time, so "zh-Hant-TW" falls back
+// to "zh-Hant" and then "zh". After each tag, its Fallbacks are tried in the
+// same way. Default is used if none of them have a translation. Tags are
+// matched without regard to case, and "_" is accepted in place of "-".
+type NotificationCatalog struct {
+	Messages map[string]*Notification
+	// Fallbacks lists more tags to try for a tag, such as "pt-PT" for
+	// "pt-BR", before it is shortened.
+	Fallbacks map[string][]string
+	// Default is the tag of the translation for locales with no other.
+	Default string
+}
+
+// Lookup returns the translation for a locale and the tag it was found under,
+// or nil if there is none.
+func (c *NotificationCatalog) Lookup(locale string) (*Notification, string) {
+	tried := make(map[string]bool)
+	var lookup func(tag string) (*Notification, string)
+	lookup = func(tag string) (*Notification, string) {
+		for tag = normalizeTag(tag); tag != ""; tag = parentTag(tag) {
+			if tried[tag] {
+				continue
+			}
+			tried[tag] = true
+			if n, t := c.message(tag); n != nil {
+				return n, t
+			}
+			for _, f := range c.fallbacks(tag) {
+				if n, t := lookup(f); n != nil {
+					return n, t
+				}
+			}
+		}
+		return nil, ""
+	}
+	if n, t := lookup(locale); n != nil {
+		return n, t
+	}
+	return lookup(c.Default)
+}
+
+// Localize returns a copy of the translation for a locale, with its Lang set
+// to the tag that was chosen.
+func (c *NotificationCatalog) Localize(locale string) (*Notification, error) {
+	n, tag := c.Lookup(locale)
+	if n == nil {
+		return nil, fmt.Errorf("webpush: no translation for locale %q", locale)
+	}
+	localized := *n
+	localized.Lang = tag
+	return &localized, nil
+}
+
+// PayloadFunc returns a PayloadFunc for SendBatch that sends each recipient
+// the translation for their subscription's Locale, with its body shortened to
+// fit the encoding as TruncatedPayload does. Use PayloadFuncFor if the
+// messages are signed or compressed.
+func (c *NotificationCatalog) PayloadFunc(encoding ContentEncoding) PayloadFunc {
+	return func(r *Recipient) (string, error) {
+		n, err := c.Localize(r.Subscription.Locale)
+		if err != nil {
+			return "", err
+		}
+		return n.TruncatedPayload(encoding)
+	}
+}
+
+// PayloadFuncFor is like PayloadFunc, but shortens bodies to fit once they
+// have been signed and compressed as the options that are passed to SendBatch
+// ask, as TruncatedPayloadFor does.
+func (c *NotificationCatalog) PayloadFuncFor(opts *Options) PayloadFunc {
+	return func(r *Recipient) (string, error) {
+		n, err := c.Localize(r.Subscription.Locale)
+		if err != nil {
+			return "", err
+		}
+		return n.TruncatedPayloadFor(r.Subscription, opts)
+	}
+}
+
+func (c *NotificationCatalog) message(tag string) (*Notification, string) {
+	for t, n := range c.Messages {
+		if n != nil && normalizeTag(t) == tag {
+			return n, t
+		}
+	}
+	return nil, ""
+}
+
+func (c *NotificationCatalog) fallbacks(tag string) []string {
+	for t, f := range c.Fallbacks {
+		if normalizeTag(t) == tag {
+			return f
+		}
+	}
+	return nil
+}
+
+// normalizeTag returns a language tag in lower case with "-" separators.
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(tag), "_", "-", -1))
+}
+
+// parentTag removes the last subtag of a normalized tag, along with a
+// single-letter subtag left before it, such as the "u" in "en-u-ca".
+func parentTag(tag string) string {
+	i := strings.LastIndex(tag, "-")
+	if i < 0 {
+		return ""
+	}
+	tag = tag[:i]
+	if i = strings.LastIndex(tag, "-"); i >= 0 && len(tag)-i == 2 {
+		tag = tag[:i]
+	}
+	return tag
+}
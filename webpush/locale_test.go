@@ -0,0 +1,147 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webpush
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func newTestCatalog() *NotificationCatalog {
+	return &NotificationCatalog{
+		Messages: map[string]*Notification{
+			"en":      {Title: "Hello"},
+			"pt-PT":   {Title: "Olá"},
+			"zh-Hant": {Title: "你好"},
+			"zh":      {Title: "你好 (简体)"},
+		},
+		Fallbacks: map[string][]string{"pt-BR": {"pt-PT"}},
+		Default:   "en",
+	}
+}
+
+func TestCatalogLookup(t *testing.T) {
+	c := newTestCatalog()
+	tests := []struct{ locale, tag string }{
+		{"en", "en"},
+		{"en-GB", "en"},
+		{"EN_us", "en"},
+		{"pt-BR", "pt-PT"},
+		{"pt", "en"},
+		{"zh-Hant-TW", "zh-Hant"},
+		{"zh-hant", "zh-Hant"},
+		{"zh-CN", "zh"},
+		{"zh-u-ca-chinese", "zh"},
+		{"de-DE", "en"},
+		{"", "en"},
+	}
+	for _, test := range tests {
+		if _, tag := c.Lookup(test.locale); tag != test.tag {
+			t.Errorf("Lookup(%q) chose %q, expected %q", test.locale, tag, test.tag)
+		}
+	}
+
+	c.Default = ""
+	if n, _ := c.Lookup("de"); n != nil {
+		t.Errorf("Expected no translation without a default, got %v", n)
+	}
+	if _, err := c.Localize("de"); err == nil {
+		t.Error("Expected an error without a default")
+	}
+}
+
+func TestCatalogFallbackCycle(t *testing.T) {
+	c := &NotificationCatalog{
+		Messages:  map[string]*Notification{"fr": {Title: "Bonjour"}},
+		Fallbacks: map[string][]string{"nb": {"nn"}, "nn": {"nb"}},
+		Default:   "fr",
+	}
+	if _, tag := c.Lookup("nb-NO"); tag != "fr" {
+		t.Errorf("Expected the default, got %q", tag)
+	}
+}
+
+func TestSubscriptionLocaleJSON(t *testing.T) {
+	sub, _ := newTestKeys(t)
+	sub.Endpoint = "https://example.com/push"
+	sub.Locale = "pt-BR"
+	b, err := json.Marshal(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := SubscriptionFromJSON(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Locale != "pt-BR" {
+		t.Errorf("Expected the locale to survive JSON, got %q from %s", decoded.Locale, b)
+	}
+}
+
+func TestSendBatchLocalized(t *testing.T) {
+	received := make(map[string]string)
+	ts, newSub := newDecryptingServer(t, received)
+	defer ts.Close()
+
+	locales := map[string]string{"ana": "pt-BR", "wei": "zh-Hant-HK", "max": "de"}
+	var recipients []*Recipient
+	for name, locale := range locales {
+		sub := newSub(name)
+		sub.Locale = locale
+		recipients = append(recipients, &Recipient{Subscription: sub})
+	}
+
+	for _, r := range SendBatch(nil, recipients, newTestCatalog().PayloadFunc(AESGCM), nil) {
+		if r.Err != nil || r.Result.StatusCode != http.StatusCreated {
+			t.Errorf("%s: expected the message to be sent, got %v", r.Recipient.Subscription.Endpoint, r.Err)
+		}
+	}
+
+	expected := map[string]Notification{
+		"ana": {Title: "Olá", Lang: "pt-PT"},
+		"wei": {Title: "你好", Lang: "zh-Hant"},
+		"max": {Title: "Hello", Lang: "en"},
+	}
+	for name, want := range expected {
+		var got Notification
+		if err := json.Unmarshal([]byte(received[name]), &got); err != nil {
+			t.Errorf("%s: invalid payload %q: %v", name, received[name], err)
+			continue
+		}
+		if got.Title != want.Title || got.Lang != want.Lang {
+			t.Errorf("%s: expected %+v, got %s", name, want, received[name])
+		}
+	}
+}
+
+func TestCatalogPayloadFuncFor(t *testing.T) {
+	sub, _ := newTestKeys(t)
+	sub.Endpoint = "https://push.example.net/push/a"
+	sub.Locale = "en-GB"
+	c := &NotificationCatalog{
+		Messages: map[string]*Notification{"en": {Title: "Hello", Body: strings.Repeat("a", 5000)}},
+	}
+	opts := &Options{PayloadSigner: newTestVAPID(t)}
+
+	payload, err := c.PayloadFuncFor(opts)(&Recipient{Subscription: sub})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewPushRequestWithOptions(sub, payload, opts); err != nil {
+		t.Errorf("Expected the signed payload to fit: %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webpush
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+)
+
+// ErrMessageGone is returned when cancelling a message that the push service
+// no longer has, because it was already delivered or has expired.
+var ErrMessageGone = errors.New("push message was already delivered or has expired")
+
+// PushMessage is a message that a push service has accepted but may not have
+// delivered yet, identified by its push message resource.
+type PushMessage struct {
+	// URI is the push message resource, from the Location header of the
+	// push service's response.
+	URI string
+	// ID is the message id that the push service assigned, which is the last
+	// path segment of URI.
+	ID string
+	// Client is used to cancel the message. If nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+// NewPushMessage returns a PushMessage for a push message resource URI, for
+// example one that was stored after sending the message.
+func NewPushMessage(client *http.Client, uri string) (*PushMessage, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if !u.IsAbs() {
+		return nil, fmt.Errorf("push message resource %q is not an absolute URI", uri)
+	}
+	return &PushMessage{URI: uri, ID: path.Base(u.Path), Client: client}, nil
+}
+
+// Cancel asks the push service not to deliver the message, by deleting its
+// push message resource. ErrMessageGone is returned if it is too late to do so.
+func (m *PushMessage) Cancel(ctx context.Context) error {
+	client := m.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequest("DELETE", m.URI, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return ErrMessageGone
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return fmt.Errorf("push service returned %s when cancelling the message", resp.Status)
+	}
+	return nil
+}
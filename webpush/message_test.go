@@ -0,0 +1,82 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webpush_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/googlechrome/push-encryption-go/webpush"
+	"github.com/googlechrome/push-encryption-go/webpush/webpushtest"
+)
+
+func TestCancel(t *testing.T) {
+	s := webpushtest.NewServer()
+	defer s.Close()
+	ctx := context.Background()
+
+	sub := testSubscription(t, s, "device")
+	result, err := webpush.SendWithOptions(nil, sub, "I am the walrus", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := result.Message
+	if m == nil {
+		t.Fatal("Expected the result to have a message")
+	}
+	if result.ServiceError != nil {
+		t.Errorf("Expected no error for a created message, got %v", result.ServiceError)
+	}
+	if m.URI != result.Location || m.ID == "" || !strings.HasSuffix(m.URI, "/"+m.ID) {
+		t.Errorf("Unexpected message URI %v and ID %v", m.URI, m.ID)
+	}
+
+	if err := m.Cancel(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Messages()[0].Cancelled {
+		t.Error("Expected the simulator to have cancelled the message")
+	}
+	if err := m.Cancel(ctx); err != webpush.ErrMessageGone {
+		t.Errorf("Expected ErrMessageGone cancelling twice, got %v", err)
+	}
+	if err := s.Acknowledge(m.URI); err == nil {
+		t.Error("Expected an error acknowledging a cancelled message")
+	}
+
+	// A delivered message can't be cancelled, even from a stored URI.
+	result, err = webpush.SendWithOptions(nil, sub, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Acknowledge(result.Location); err != nil {
+		t.Fatal(err)
+	}
+	m, err = webpush.NewPushMessage(nil, result.Location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.ID != result.Message.ID {
+		t.Errorf("Expected ID %v, got %v", result.Message.ID, m.ID)
+	}
+	if err := m.Cancel(ctx); err != webpush.ErrMessageGone {
+		t.Errorf("Expected ErrMessageGone cancelling a delivered message, got %v", err)
+	}
+
+	if _, err := webpush.NewPushMessage(nil, "/m/relative"); err == nil {
+		t.Error("Expected an error for a relative URI")
+	}
+}
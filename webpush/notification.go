@@ -0,0 +1,154 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webpush
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// The text appended to a truncated notification body.
+const ellipsis = "…"
+
+// PayloadTooLargeError is returned when a message is longer than an encoding
+// can carry in a single push message.
+type PayloadTooLargeError struct {
+	// Size is the length of the message in bytes.
+	Size int
+	// Max is the longest message the encoding allows.
+	Max int
+}
+
+func (e *PayloadTooLargeError) Error() string {
+	return fmt.Sprintf("Payload is too large. The max number of bytes is %d, input is %d bytes.", e.Max, e.Size)
+}
+
+// Over returns how many bytes need to be removed for the message to fit.
+func (e *PayloadTooLargeError) Over() int {
+	return e.Size - e.Max
+}
+
+// MaxPayloadLength returns the longest message that can be encrypted with the
+// encoding.
+func MaxPayloadLength(encoding ContentEncoding) int {
+	if encoding == AESGCM {
+		return aesgcmMaxPayloadLength
+	}
+	return aes128gcmMaxPayloadLength
+}
+
+// Notification is a notification for the service worker to show with
+// ServiceWorkerRegistration.showNotification. Its JSON encoding has the title
+// alongside the fields of the options argument.
+type Notification struct {
+	Title              string               `json:"title"`
+	Body               string               `json:"body,omitempty"`
+	Icon               string               `json:"icon,omitempty"`
+	Badge              string               `json:"badge,omitempty"`
+	Image              string               `json:"image,omitempty"`
+	Tag                string               `json:"tag,omitempty"`
+	Lang               string               `json:"lang,omitempty"`
+	Actions            []NotificationAction `json:"actions,omitempty"`
+	RequireInteraction bool                 `json:"requireInteraction,omitempty"`
+	// Data is any JSON encodable value for the service worker.
+	Data interface{} `json:"data,omitempty"`
+}
+
+// NotificationAction is a button shown with a notification.
+type NotificationAction struct {
+	Action string `json:"action"`
+	Title  string `json:"title"`
+	Icon   string `json:"icon,omitempty"`
+}
+
+// Payload returns the JSON encoding of the notification, or a
+// *PayloadTooLargeError if it is too long to encrypt with the encoding.
+func (n *Notification) Payload(encoding ContentEncoding) (string, error) {
+	b, err := n.marshal()
+	if err != nil {
+		return "", err
+	}
+	if max := MaxPayloadLength(encoding); len(b) > max {
+		return "", &PayloadTooLargeError{len(b), max}
+	}
+	return string(b), nil
+}
+
+// TruncatedPayload is like Payload, but if the notification is too long its
+// body is shortened to fit, on a rune boundary and ending with an ellipsis. A
+// *PayloadTooLargeError is returned if it doesn't fit even without a body. The
+// length is that of the JSON, before any signing or compression; see
+// TruncatedPayloadFor.
+func (n *Notification) TruncatedPayload(encoding ContentEncoding) (string, error) {
+	return truncateBody(n.Body, func(body string) (string, error) {
+		truncated := *n
+		truncated.Body = body
+		return truncated.Payload(encoding)
+	})
+}
+
+// TruncatedPayloadFor is like TruncatedPayload, but shortens the body until
+// the payload fits once SendWithOptions has signed and compressed it as opts
+// ask. TruncatedPayload doesn't allow for either, so use this when
+// Options.PayloadSigner or Options.Compress are set.
+func (n *Notification) TruncatedPayloadFor(sub *Subscription, opts *Options) (string, error) {
+	check, err := opts.lengthCheck(sub)
+	if err != nil {
+		return "", err
+	}
+	return truncateBody(n.Body, func(body string) (string, error) {
+		truncated := *n
+		truncated.Body = body
+		b, err := truncated.marshal()
+		if err != nil {
+			return "", err
+		}
+		return string(b), check(string(b))
+	})
+}
+
+func (n *Notification) marshal() ([]byte, error) {
+	if n.Title == "" {
+		return nil, errors.New("notification must have a title")
+	}
+	return json.Marshal(n)
+}
+
+// truncateBody returns payload(body), or if that is too large, payload of the
+// longest prefix of body followed by an ellipsis that fits.
+func truncateBody(body string, payload func(body string) (string, error)) (string, error) {
+	p, err := payload(body)
+	if _, ok := err.(*PayloadTooLargeError); !ok || body == "" {
+		return p, err
+	}
+
+	// JSON escaping means that the encoded length of the body isn't simply its
+	// length, so search for the longest prefix of the body that fits.
+	runes := []rune(body)
+	lo, hi := 0, len(runes)-1
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if _, err := payload(string(runes[:mid]) + ellipsis); err == nil {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	if lo == 0 {
+		return payload("")
+	}
+	return payload(string(runes[:lo]) + ellipsis)
+}
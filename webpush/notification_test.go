@@ -0,0 +1,164 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webpush
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestNotificationPayload(t *testing.T) {
+	n := &Notification{
+		Title:   "New message",
+		Body:    "Hello",
+		Icon:    "/icon.png",
+		Tag:     "chat",
+		Actions: []NotificationAction{{Action: "reply", Title: "Reply"}},
+		Data:    map[string]string{"url": "/chat/1"},
+	}
+	payload, err := n.Payload(AES128GCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"title":"New message","body":"Hello","icon":"/icon.png","tag":"chat","actions":[{"action":"reply","title":"Reply"}],"data":{"url":"/chat/1"}}`
+	if payload != expected {
+		t.Errorf("Expected %s, got %s", expected, payload)
+	}
+
+	if _, err := (&Notification{Body: "Hello"}).Payload(AES128GCM); err == nil {
+		t.Error("Expected an error without a title")
+	}
+}
+
+func TestNotificationTooLarge(t *testing.T) {
+	n := &Notification{Title: "Hi", Body: strings.Repeat("a", 4100)}
+	size := len(`{"title":"Hi","body":""}`) + 4100
+
+	_, err := n.Payload(AES128GCM)
+	tooLarge, ok := err.(*PayloadTooLargeError)
+	if !ok {
+		t.Fatalf("Expected a *PayloadTooLargeError, got %v", err)
+	}
+	if tooLarge.Size != size || tooLarge.Max != 4057 || tooLarge.Over() != size-4057 {
+		t.Errorf("Unexpected error %+v", tooLarge)
+	}
+
+	_, err = n.Payload(AESGCM)
+	if tooLarge, ok := err.(*PayloadTooLargeError); !ok || tooLarge.Over() != size-4078 {
+		t.Errorf("Expected to be %d bytes over for aesgcm, got %v", size-4078, err)
+	}
+
+	sub, err := SubscriptionFromJSON(subscriptionJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Encrypt(sub, strings.Repeat(" ", 4060), AES128GCM); err == nil || err.(*PayloadTooLargeError).Over() != 3 {
+		t.Errorf("Expected Encrypt to be 3 bytes over, got %v", err)
+	}
+}
+
+func TestNotificationTruncatedPayload(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"ascii", strings.Repeat("a", 5000)},
+		{"multibyte", strings.Repeat("é€😀", 1000)},
+		{"escaped", strings.Repeat(`<"\`, 2000)},
+	}
+	for _, test := range tests {
+		n := &Notification{Title: "Hi", Body: test.body}
+		payload, err := n.TruncatedPayload(AES128GCM)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if len(payload) > 4057 || len(payload) < 4057-8 {
+			t.Errorf("%s: expected the payload to fill the budget, got %d bytes", test.name, len(payload))
+		}
+		var decoded Notification
+		if err := json.Unmarshal([]byte(payload), &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if !utf8.ValidString(decoded.Body) || !strings.HasSuffix(decoded.Body, ellipsis) {
+			t.Errorf("%s: expected a valid body ending with an ellipsis", test.name)
+		}
+		if !strings.HasPrefix(test.body, strings.TrimSuffix(decoded.Body, ellipsis)) {
+			t.Errorf("%s: expected the body to be a prefix of the original", test.name)
+		}
+	}
+
+	n := &Notification{Title: "Hi", Body: "short"}
+	if payload, _ := n.TruncatedPayload(AES128GCM); payload != `{"title":"Hi","body":"short"}` {
+		t.Errorf("Expected a short body to be kept, got %s", payload)
+	}
+
+	n = &Notification{Title: strings.Repeat("a", 4100), Body: "text"}
+	if _, err := n.TruncatedPayload(AES128GCM); err == nil {
+		t.Error("Expected an error when the title alone is too long")
+	}
+}
+
+func TestNotificationTruncatedPayloadFor(t *testing.T) {
+	sub, err := SubscriptionFromJSON(subscriptionJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := &remoteSigner{key: newTestVAPID(t).PrivateKey}
+	signer := &VAPID{Signer: remote}
+	n := &Notification{Title: "Hi", Body: strings.Repeat("a", 5000)}
+
+	unsigned, err := n.TruncatedPayload(AESGCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedOpts := &Options{PayloadSigner: signer}
+	if _, err := NewPushRequestWithOptions(sub, unsigned, signedOpts); err == nil {
+		t.Fatal("Expected TruncatedPayload not to allow for the signature")
+	}
+	remote.signs = 0
+	signed, err := n.TruncatedPayloadFor(sub, signedOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remote.signs != 1 {
+		t.Errorf("Expected the payload to be signed once while truncating, got %d signatures", remote.signs)
+	}
+	if len(signed) >= len(unsigned) {
+		t.Errorf("Expected the body to be shorter to make room for the signature, got %d bytes", len(signed))
+	}
+	if _, err := NewPushRequestWithOptions(sub, signed, signedOpts); err != nil {
+		t.Errorf("Expected the signed payload to fit: %v", err)
+	}
+
+	// Compression lets the whole body fit.
+	compressed, err := n.TruncatedPayloadFor(sub, &Options{PayloadSigner: signer, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compressed != `{"title":"Hi","body":"`+n.Body+`"}` {
+		t.Errorf("Expected the body not to be truncated, got %d bytes", len(compressed))
+	}
+
+	if payload, err := n.TruncatedPayloadFor(sub, nil); err != nil || payload != unsigned {
+		t.Errorf("Expected nil options to truncate as TruncatedPayload(AESGCM), got %d bytes, %v", len(payload), err)
+	}
+	longer, _ := n.TruncatedPayload(AES128GCM)
+	if payload, err := n.TruncatedPayloadFor(sub, &Options{Encoding: AES128GCM}); err != nil || payload != longer {
+		t.Errorf("Expected the options' encoding to be allowed for, got %d bytes, %v", len(payload), err)
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webpush
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// PushServiceError is the reason a push service gave for rejecting a message.
+type PushServiceError struct {
+	StatusCode int
+	// Code is the push service's own code for the error, such as the errno of
+	// autopush or the reason of Apple's push service, if it gave one.
+	Code string
+	// Message describes the error.
+	Message string
+	// MoreInfo is a URL with more information about the error, if given.
+	MoreInfo string
+}
+
+func (e *PushServiceError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("push service returned %d (%s): %s", e.StatusCode, e.Code, e.Message)
+	}
+	return fmt.Sprintf("push service returned %d: %s", e.StatusCode, e.Message)
+}
+
+// Provider describes the quirks of a push service.
+type Provider struct {
+	// Name identifies the push service, such as "fcm".
+	Name string
+	// Hosts are the hosts of the push service's endpoints. A host starting with
+	// "*." also matches any of its subdomains.
+	Hosts []string
+	// MaxTTL is the longest TTL in seconds that the push service accepts.
+	// Longer TTLs are reduced to it. Zero means there is no limit.
+	MaxTTL int
+	// NoTopic is set if the push service rejects or ignores the Topic header,
+	// in which case it isn't sent.
+	NoTopic bool
+	// AES128GCMOnly is set if the push service only accepts messages encrypted
+	// with AES128GCM, which is then used whatever Options.Encoding is.
+	AES128GCMOnly bool
+	// ParseError fills in the details of an error response from the headers
+	// and body that the push service sent.
+	ParseError func(e *PushServiceError, h http.Header, body []byte)
+}
+
+// Providers are the push services known to DetectProvider. The limits are
+// those documented by each service.
+var Providers = []*Provider{
+	{
+		Name:       "fcm",
+		Hosts:      []string{"fcm.googleapis.com"},
+		MaxTTL:     28 * 24 * 60 * 60,
+		ParseError: parseTextError,
+	},
+	{
+		Name:       "autopush",
+		Hosts:      []string{"*.push.services.mozilla.com"},
+		MaxTTL:     60 * 24 * 60 * 60,
+		ParseError: parseAutopushError,
+	},
+	{
+		Name:          "apple",
+		Hosts:         []string{"*.push.apple.com"},
+		MaxTTL:        30 * 24 * 60 * 60,
+		AES128GCMOnly: true,
+		ParseError:    parseAppleError,
+	},
+	{
+		Name:       "wns",
+		Hosts:      []string{"*.notify.windows.com"},
+		NoTopic:    true,
+		ParseError: parseWNSError,
+	},
+}
+
+// DetectProvider returns the provider of the push service that the endpoint
+// belongs to, or nil if it isn't one of Providers.
+func DetectProvider(endpoint string) *Provider {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil
+	}
+	host, _ := splitHost(u)
+	for _, p := range Providers {
+		for _, pattern := range p.Hosts {
+			if matchHost(host, pattern) {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+// ttl returns the TTL to send to the push service.
+func (p *Provider) ttl(ttl int) int {
+	if p != nil && p.MaxTTL > 0 && ttl > p.MaxTTL {
+		return p.MaxTTL
+	}
+	return ttl
+}
+
+// parseError returns the error described by an error response.
+func (p *Provider) parseError(status int, h http.Header, body []byte) *PushServiceError {
+	e := &PushServiceError{StatusCode: status}
+	if p == nil || p.ParseError == nil {
+		parseTextError(e, h, body)
+	} else {
+		p.ParseError(e, h, body)
+	}
+	if e.Message == "" {
+		e.Message = describeStatus(status)
+	}
+	return e
+}
+
+// describeStatus describes what the status codes of RFC 8030 and RFC 8292 mean
+// for a push request.
+func describeStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "malformed push request"
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return "VAPID or authorization token rejected"
+	case http.StatusNotFound, http.StatusGone:
+		return "subscription expired or unsubscribed"
+	case http.StatusRequestEntityTooLarge:
+		return "payload too large"
+	case http.StatusTooManyRequests:
+		return "too many requests"
+	}
+	return strings.ToLower(http.StatusText(status))
+}
+
+// parseTextError uses the first line of a plain text error body.
+func parseTextError(e *PushServiceError, h http.Header, body []byte) {
+	if !strings.HasPrefix(h.Get("Content-Type"), "text/plain") && h.Get("Content-Type") != "" {
+		return
+	}
+	line := body
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	e.Message = strings.TrimSpace(string(line))
+}
+
+// parseAutopushError parses the JSON errors of Mozilla's autopush, such as
+// {"code": 404, "errno": 102, "error": "Not Found", "message": "..."}.
+func parseAutopushError(e *PushServiceError, h http.Header, body []byte) {
+	var ae struct {
+		Errno    int    `json:"errno"`
+		Error    string `json:"error"`
+		Message  string `json:"message"`
+		MoreInfo string `json:"more_info"`
+	}
+	if json.Unmarshal(body, &ae) != nil {
+		return
+	}
+	if ae.Errno != 0 {
+		e.Code = strconv.Itoa(ae.Errno)
+	}
+	e.Message = ae.Message
+	if e.Message == "" {
+		e.Message = ae.Error
+	}
+	e.MoreInfo = ae.MoreInfo
+}
+
+// What the reasons given by Apple's push service mean.
+var appleReasons = map[string]string{
+	"BadDeviceToken":       "subscription is not valid",
+	"BadExpirationDate":    "invalid TTL",
+	"BadJwtToken":          "VAPID token is invalid",
+	"BadPriority":          "invalid Urgency",
+	"BadWebPushTopic":      "invalid Topic",
+	"ExpiredProviderToken": "VAPID token expired",
+	"PayloadTooLarge":      "payload too large",
+	"TooManyRequests":      "too many requests",
+	"Unregistered":         "subscription expired or unsubscribed",
+	"VapidPkHashMismatch":  "VAPID key does not match the subscription's applicationServerKey",
+}
+
+// parseAppleError parses the JSON errors of Apple's push service, such as
+// {"reason": "BadJwtToken"}.
+func parseAppleError(e *PushServiceError, h http.Header, body []byte) {
+	var ae struct {
+		Reason string `json:"reason"`
+	}
+	if json.Unmarshal(body, &ae) != nil || ae.Reason == "" {
+		return
+	}
+	e.Code = ae.Reason
+	e.Message = appleReasons[ae.Reason]
+}
+
+// parseWNSError uses the error description header of the Windows Push
+// Notification Services.
+func parseWNSError(e *PushServiceError, h http.Header, body []byte) {
+	e.Message = h.Get("X-WNS-Error-Description")
+}
@@ -0,0 +1,164 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webpush
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDetectProvider(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		name     string
+	}{
+		{"https://fcm.googleapis.com/fcm/send/abc", "fcm"},
+		{"https://updates.push.services.mozilla.com/wpush/v2/abc", "autopush"},
+		{"https://web.push.apple.com/QGuQyavXut", "apple"},
+		{"https://wns2-par02p.notify.windows.com/w/?token=abc", "wns"},
+		{"https://push.example.net/push/abc", ""},
+		{"://bad", ""},
+	}
+	for _, test := range tests {
+		p := DetectProvider(test.endpoint)
+		if test.name == "" && p != nil {
+			t.Errorf("%s: expected no provider, got %s", test.endpoint, p.Name)
+		}
+		if test.name != "" && (p == nil || p.Name != test.name) {
+			t.Errorf("%s: expected %s, got %v", test.endpoint, test.name, p)
+		}
+	}
+}
+
+func TestProviderQuirks(t *testing.T) {
+	req, err := NewPushRequestWithOptions(&Subscription{Endpoint: "https://fcm.googleapis.com/fcm/send/abc"}, "", &Options{
+		TTL:   365 * 24 * 60 * 60,
+		Topic: "news",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl := req.Header.Get("TTL"); ttl != "2419200" {
+		t.Errorf("Expected the TTL to be reduced to 4 weeks, got %v", ttl)
+	}
+	if req.Header.Get("Topic") != "news" {
+		t.Error("Expected the Topic header for FCM")
+	}
+
+	req, err = NewPushRequestWithOptions(&Subscription{Endpoint: "https://wns2-par02p.notify.windows.com/w/?token=abc"}, "", &Options{
+		TTL:   365 * 24 * 60 * 60,
+		Topic: "news",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl := req.Header.Get("TTL"); ttl != "31536000" {
+		t.Errorf("Expected the TTL to be unchanged, got %v", ttl)
+	}
+	if req.Header.Get("Topic") != "" {
+		t.Error("Expected no Topic header for WNS")
+	}
+}
+
+func TestProviderEncoding(t *testing.T) {
+	keys, _ := newTestKeys(t)
+	tests := []struct {
+		endpoint string
+		opts     *Options
+		encoding string
+	}{
+		{"https://fcm.googleapis.com/fcm/send/abc", nil, "aesgcm"},
+		{"https://fcm.googleapis.com/fcm/send/abc", &Options{Encoding: AES128GCM}, "aes128gcm"},
+		{"https://web.push.apple.com/QGuQyavXut", nil, "aes128gcm"},
+		{"https://web.push.apple.com/QGuQyavXut", &Options{Encoding: AESGCM}, "aes128gcm"},
+	}
+	for _, test := range tests {
+		sub := *keys
+		sub.Endpoint = test.endpoint
+		req, err := NewPushRequestWithOptions(&sub, "Hello", test.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encoding := req.Header.Get("Content-Encoding"); encoding != test.encoding {
+			t.Errorf("%s %+v: expected %s, got %s", test.endpoint, test.opts, test.encoding, encoding)
+		}
+	}
+}
+
+func TestProviderParseError(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		contentType string
+		body        string
+		code        string
+		message     string
+	}{
+		{"fcm", 403, "text/plain; charset=utf-8", "the key in the authorization header does not correspond to the sender ID\n\nmore", "", "the key in the authorization header does not correspond to the sender ID"},
+		{"fcm", 404, "text/html", "<html>", "", "subscription expired or unsubscribed"},
+		{"autopush", 410, "application/json", `{"code": 410, "errno": 106, "error": "Gone", "message": "Request did not validate No such subscription"}`, "106", "Request did not validate No such subscription"},
+		{"autopush", 404, "application/json", `{"code": 404, "errno": 102, "error": "Not Found"}`, "102", "Not Found"},
+		{"apple", 403, "application/json", `{"reason": "BadJwtToken"}`, "BadJwtToken", "VAPID token is invalid"},
+		{"apple", 403, "application/json", `{"reason": "ExpiredProviderToken"}`, "ExpiredProviderToken", "VAPID token expired"},
+		{"apple", 400, "application/json", `{"reason": "SomethingNew"}`, "SomethingNew", "malformed push request"},
+		{"apple", 500, "application/json", `not json`, "", "internal server error"},
+		{"", 401, "", "", "", "VAPID or authorization token rejected"},
+	}
+	for _, test := range tests {
+		var p *Provider
+		for _, provider := range Providers {
+			if provider.Name == test.name {
+				p = provider
+			}
+		}
+		h := http.Header{"Content-Type": {test.contentType}}
+		e := p.parseError(test.status, h, []byte(test.body))
+		if e.StatusCode != test.status || e.Code != test.code || e.Message != test.message {
+			t.Errorf("%s: expected %d %q %q, got %+v", test.name, test.status, test.code, test.message, e)
+		}
+	}
+
+	e := &PushServiceError{StatusCode: 403, Code: "BadJwtToken", Message: "VAPID token is invalid"}
+	if e.Error() != "push service returned 403 (BadJwtToken): VAPID token is invalid" {
+		t.Errorf("Unexpected error string %q", e.Error())
+	}
+}
+
+func TestSendParsesProviderError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"reason": "BadJwtToken"}`)
+	}))
+	defer ts.Close()
+
+	orig := Providers
+	defer func() { Providers = orig }()
+	apple := &Provider{Name: "apple", Hosts: []string{"127.0.0.1"}, ParseError: parseAppleError}
+	Providers = []*Provider{apple}
+
+	result, err := SendWithOptions(nil, &Subscription{Endpoint: ts.URL}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Provider != apple {
+		t.Errorf("Expected the apple provider, got %v", result.Provider)
+	}
+	if result.ServiceError == nil || result.ServiceError.Code != "BadJwtToken" {
+		t.Errorf("Expected the reason BadJwtToken, got %v", result.ServiceError)
+	}
+}
@@ -17,37 +17,160 @@ package webpush
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
+// maxResponseLength limits how much of a push service response is read.
+const maxResponseLength = 64 << 10
+
+// Urgency indicates how soon a message needs to be delivered, so that user
+// agents can save battery by waiting to receive less urgent messages. See
+// section 5.3 of RFC 8030.
+type Urgency string
+
+// The urgencies defined by RFC 8030.
 const (
-	gcmURL     = "https://android.googleapis.com/gcm/send"
-	tempGcmURL = "https://gcm-http.googleapis.com/gcm"
+	UrgencyVeryLow Urgency = "very-low"
+	UrgencyLow     Urgency = "low"
+	UrgencyNormal  Urgency = "normal"
+	UrgencyHigh    Urgency = "high"
 )
 
+// Options holds the optional parameters of a push request. A nil *Options is
+// the same as the zero value.
+type Options struct {
+	// Token is sent in the Authorization header as "key=<token>" for push
+	// services that require it.
+	Token string
+	// VAPID identifies the application server to the push service. It can't be
+	// used together with Token, as both use the Authorization header.
+	VAPID *VAPID
+	// VAPIDKeys signs the request with the key of the ring that the
+	// subscription was created with. It can't be used together with Token or
+	// VAPID.
+	VAPIDKeys *VAPIDKeyRing
+	// TTL is how many seconds the push service should keep the message if the
+	// user agent isn't available. With the default of zero the message is
+	// dropped unless it can be delivered straight away. It is reduced to the
+	// MaxTTL of the push service's Provider.
+	TTL int
+	// Urgency is sent in the Urgency header if set.
+	Urgency Urgency
+	// Topic lets a message replace an earlier undelivered message with the same
+	// topic. It is at most 32 characters of the URL-safe base64 alphabet. It
+	// isn't sent to push services whose Provider has NoTopic set.
+	Topic string
+	// ReceiptURI asks the push service for a delivery receipt, which it sends to
+	// this receipt subscription once the user agent has acknowledged the
+	// message. See ReceiptSubscription and section 5.1 of RFC 8030.
+	ReceiptURI string
+	// EndpointPolicy checks the subscription's endpoint before the request is
+	// made. If nil, DefaultEndpointPolicy is used.
+	EndpointPolicy EndpointPolicy
+	// PayloadSigner signs the message before it is encrypted, so that the
+	// user agent can check that it came from the application server. See
+	// VAPID.SignPayload.
+	PayloadSigner *VAPID
+	// Compress compresses the message with CompressPayload before it is
+	// encrypted, so that it is the compressed message that must fit in
+	// MaxPayloadLength. The user agent must decode it with DecompressPayload
+	// or its JavaScript equivalent.
+	Compress bool
+	// Encoding is the content encoding the message is encrypted with. The
+	// default of AESGCM is accepted by most push services, but AES128GCM is
+	// used for those whose Provider has AES128GCMOnly set.
+	Encoding ContentEncoding
+}
+
 // NewPushRequest creates a valid Web Push HTTP request for sending a message
-// to a subscriber. If the push service requires an authentication header
-// (notably Google Cloud Messaging, used by Chrome) then you can add that as the
-// token parameter.
+// to a subscriber. If the push service requires an authentication header then
+// you can add that as the token parameter.
 func NewPushRequest(sub *Subscription, message string, token string) (*http.Request, error) {
-	// If the endpoint is GCM then we temporarily need to rewrite it, as not all
-	// GCM servers support the Web Push protocol. This should go away in the
-	// future.
-	endpoint := strings.Replace(sub.Endpoint, gcmURL, tempGcmURL, 1)
+	return NewPushRequestWithOptions(sub, message, &Options{Token: token})
+}
 
-	req, err := http.NewRequest("POST", endpoint, nil)
+// NewPushRequestWithOptions is like NewPushRequest, with the optional
+// parameters given by opts.
+func NewPushRequestWithOptions(sub *Subscription, message string, opts *Options) (*http.Request, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	req, err := http.NewRequest("POST", sub.Endpoint, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	// TODO: Make the TTL variable
-	req.Header.Add("TTL", "0")
+	policy := opts.EndpointPolicy
+	if policy == nil {
+		policy = DefaultEndpointPolicy
+	}
+	host := req.Host
+	if err := policy.CheckEndpoint(req); err != nil {
+		return nil, err
+	}
+	if req.Host == host {
+		// Follow a rewritten URL, unless the policy chose the Host header itself.
+		req.Host = req.URL.Host
+	}
+	endpoint := req.URL.String()
+	provider := DetectProvider(endpoint)
+
+	if opts.TTL < 0 {
+		return nil, fmt.Errorf("TTL must not be negative, was %d", opts.TTL)
+	}
+	req.Header.Add("TTL", strconv.Itoa(provider.ttl(opts.TTL)))
+
+	if opts.Urgency != "" {
+		if opts.Urgency.Rank() < 0 {
+			return nil, fmt.Errorf("unknown urgency %q", opts.Urgency)
+		}
+		req.Header.Add("Urgency", string(opts.Urgency))
+	}
+
+	if opts.Topic != "" {
+		if !ValidTopic(opts.Topic) {
+			return nil, fmt.Errorf("topic %q must be at most 32 characters of the URL-safe base64 alphabet", opts.Topic)
+		}
+		if provider == nil || !provider.NoTopic {
+			req.Header.Add("Topic", opts.Topic)
+		}
+	}
+
+	vapid := opts.VAPID
+	if opts.VAPIDKeys != nil {
+		if vapid != nil {
+			return nil, errors.New("a push request can't use both VAPID and VAPIDKeys")
+		}
+		if vapid, err = opts.VAPIDKeys.Key(sub); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Token != "" && vapid != nil {
+		return nil, errors.New("a push request can't use both a Token and VAPID")
+	}
+
+	if opts.Token != "" {
+		req.Header.Add("Authorization", fmt.Sprintf(`key=%s`, opts.Token))
+	}
+
+	if vapid != nil {
+		if err := vapid.ApplyHeaders(req.Header, endpoint); err != nil {
+			return nil, err
+		}
+	}
 
-	if token != "" {
-		req.Header.Add("Authorization", fmt.Sprintf(`key=%s`, token))
+	if opts.ReceiptURI != "" {
+		req.Header.Add("Prefer", "respond-async")
+		req.Header.Add("Push-Receipt", opts.ReceiptURI)
 	}
 
 	// If there is no payload then we don't actually need encryption
@@ -55,25 +178,115 @@ func NewPushRequest(sub *Subscription, message string, token string) (*http.Requ
 		return req, nil
 	}
 
-	payload, err := Encrypt(sub, message, AESGCM)
+	if message, err = opts.plaintext(sub, message); err != nil {
+		return nil, err
+	}
+
+	payload, err := Encrypt(sub, message, opts.encoding(provider))
 	if err != nil {
 		return nil, err
 	}
 
-	req.Body = ioutil.NopCloser(bytes.NewReader(payload.Ciphertext))
-	req.ContentLength = int64(len(payload.Ciphertext))
-	req.Header.Add("Encryption", headerField("salt", payload.Salt))
-	req.Header.Add("Crypto-Key", headerField("dh", payload.ServerPublicKey))
-	req.Header.Add("Content-Encoding", "aesgcm")
+	payload.Apply(req)
 
 	return req, nil
 }
 
+// plaintext returns the message as it is encrypted: signed by PayloadSigner
+// and compressed, if the options ask for that.
+func (o *Options) plaintext(sub *Subscription, message string) (string, error) {
+	if o == nil {
+		return message, nil
+	}
+	if o.PayloadSigner != nil {
+		var err error
+		if message, err = o.PayloadSigner.SignPayload(sub, message); err != nil {
+			return "", err
+		}
+	}
+	if o.Compress {
+		message = CompressPayload(message)
+	}
+	return message, nil
+}
+
+// encoding returns the content encoding to encrypt messages to the push
+// service with.
+func (o *Options) encoding(p *Provider) ContentEncoding {
+	if p != nil && p.AES128GCMOnly {
+		return AES128GCM
+	}
+	if o == nil {
+		return AESGCM
+	}
+	return o.Encoding
+}
+
+// lengthCheck returns a function that reports a *PayloadTooLargeError if a
+// message is too long to send to the subscription with the options. So that
+// many messages can be measured, PayloadSigner signs at most once: a signature
+// doesn't depend on the length of what is signed, so each message is measured
+// wrapped with the signature of an empty one.
+func (o *Options) lengthCheck(sub *Subscription) (func(message string) error, error) {
+	max := MaxPayloadLength(o.encoding(DetectProvider(sub.Endpoint)))
+	var signed *SignedPayload
+	if o != nil && o.PayloadSigner != nil {
+		empty, err := o.PayloadSigner.SignPayload(sub, "")
+		if err != nil {
+			return nil, err
+		}
+		var p signedPayloadJSON
+		if err := json.Unmarshal([]byte(empty), &p); err != nil {
+			return nil, err
+		}
+		signed = p.Signed
+	}
+
+	return func(message string) error {
+		if signed != nil {
+			s := *signed
+			s.Message = message
+			b, err := json.Marshal(signedPayloadJSON{&s})
+			if err != nil {
+				return err
+			}
+			message = string(b)
+		}
+		if o != nil && o.Compress {
+			message = CompressPayload(message)
+		}
+		if len(message) > max {
+			return &PayloadTooLargeError{len(message), max}
+		}
+		return nil
+	}, nil
+}
+
+// Apply sets the body of the request to the ciphertext and adds the headers
+// that the encoding requires, as described by ApplyHeaders.
+func (r *EncryptionResult) Apply(req *http.Request) {
+	r.ApplyHeaders(req.Header)
+	req.Body = ioutil.NopCloser(bytes.NewReader(r.Ciphertext))
+	req.ContentLength = int64(len(r.Ciphertext))
+}
+
+// ApplyHeaders sets the HTTP headers needed to deliver the ciphertext. For
+// aesgcm the salt and server public key travel in the Encryption and Crypto-Key
+// headers. For aes128gcm they are part of the ciphertext, so only the
+// Content-Encoding header is set. Other parameters of an existing Crypto-Key
+// header, such as the p256ecdsa key of draft VAPID, are kept.
+func (r *EncryptionResult) ApplyHeaders(h http.Header) {
+	h.Set("Content-Encoding", r.Encoding.String())
+	if r.Encoding == AESGCM {
+		h.Set("Encryption", headerField("salt", r.Salt))
+		setHeaderParam(h, "Crypto-Key", "dh", base64.URLEncoding.EncodeToString(r.ServerPublicKey))
+	}
+}
+
 // Send a message using the Web Push protocol to the recipient identified by the
 // given subscription object. If the client is nil then the default HTTP client
-// will be used. If the push service requires an authentication header (notably
-// Google Cloud Messaging, used by Chrome) then you can add that as the token
-// parameter.
+// will be used. If the push service requires an authentication header then you
+// can add that as the token parameter.
 func Send(client *http.Client, sub *Subscription, message, token string) (*http.Response, error) {
 	if client == nil {
 		client = http.DefaultClient
@@ -87,7 +300,116 @@ func Send(client *http.Client, sub *Subscription, message, token string) (*http.
 	return client.Do(req)
 }
 
+// Rank orders urgencies from UrgencyVeryLow (0) to UrgencyHigh (3). It returns
+// -1 for unknown urgencies.
+func (u Urgency) Rank() int {
+	switch u {
+	case UrgencyVeryLow:
+		return 0
+	case UrgencyLow:
+		return 1
+	case UrgencyNormal:
+		return 2
+	case UrgencyHigh:
+		return 3
+	}
+	return -1
+}
+
+// ValidTopic reports whether topic can be used as the Topic of a message, as
+// described in section 5.4 of RFC 8030.
+func ValidTopic(topic string) bool {
+	if len(topic) == 0 || len(topic) > 32 {
+		return false
+	}
+	for _, c := range topic {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// Result is the response of the push service to a message.
+type Result struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	// Location is the URI of the push message resource that the push service
+	// created for the message. Delivery receipts refer to the message by it.
+	Location string
+	// Message can be used to cancel the message before it is delivered. It is
+	// nil if the push service didn't return a push message resource.
+	Message *PushMessage
+	// Provider is the push service that the message was sent to, or nil if it
+	// isn't a known one.
+	Provider *Provider
+	// ServiceError describes why the push service rejected the message. It is
+	// nil unless the status code is 400 or more.
+	ServiceError *PushServiceError
+}
+
+// SendWithOptions is like Send, with the optional parameters given by opts.
+// The response is read and closed, and returned as a Result. An error is only
+// returned if the request couldn't be made, not for error status codes.
+func SendWithOptions(client *http.Client, sub *Subscription, message string, opts *Options) (*Result, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := NewPushRequestWithOptions(sub, message, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseLength))
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       body,
+		Provider:   DetectProvider(req.URL.String()),
+	}
+	if resp.StatusCode >= 400 {
+		result.ServiceError = result.Provider.parseError(resp.StatusCode, resp.Header, body)
+	}
+	if resp.StatusCode == http.StatusCreated {
+		if loc, err := resp.Location(); err == nil {
+			result.Location = loc.String()
+			result.Message, _ = NewPushMessage(client, result.Location)
+		}
+	}
+	return result, nil
+}
+
 // A helper for creating the value part of the HTTP encryption headers
 func headerField(headerType string, value []byte) string {
 	return fmt.Sprintf(`%s=%s`, headerType, base64.URLEncoding.EncodeToString(value))
 }
+
+// setHeaderParam sets a parameter of a header like Crypto-Key, which holds
+// parameters separated by semicolons, replacing any earlier value of the
+// parameter and keeping the others.
+func setHeaderParam(h http.Header, header, name, value string) {
+	var params []string
+	for _, param := range strings.FieldsFunc(h.Get(header), func(r rune) bool {
+		return r == ';' || r == ','
+	}) {
+		param = strings.TrimSpace(param)
+		kv := strings.SplitN(param, "=", 2)
+		if param != "" && !strings.EqualFold(kv[0], name) {
+			params = append(params, param)
+		}
+	}
+	params = append(params, name+"="+value)
+	h.Set(header, strings.Join(params, ";"))
+}
@@ -69,7 +69,7 @@ func TestSendWebPush(t *testing.T) {
 		t.Error(err)
 	}
 
-	sub := &Subscription{ts.URL, key, auth}
+	sub := &Subscription{Endpoint: ts.URL, Key: key, Auth: auth}
 	message := "I am the walrus"
 
 	if _, err = Send(nil, sub, message, ""); err != nil {
@@ -105,3 +105,81 @@ func TestSendTickle(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestEncryptionResultApplyHeaders(t *testing.T) {
+	sub, err := SubscriptionFromJSON(subscriptionJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := Encrypt(sub, message, AESGCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := http.Header{}
+	result.ApplyHeaders(h)
+	if h.Get("Content-Encoding") != "aesgcm" {
+		t.Errorf("Expected Content-Encoding header to be aesgcm, got %v", h.Get("Content-Encoding"))
+	}
+	if !strings.HasPrefix(h.Get("Crypto-Key"), "dh=") {
+		t.Errorf("Expected Crypto-Key header to have a dh field, got %v", h.Get("Crypto-Key"))
+	}
+	if !strings.HasPrefix(h.Get("Encryption"), "salt=") {
+		t.Errorf("Expected Encryption header to have a salt field, got %v", h.Get("Encryption"))
+	}
+
+	result, err = Encrypt(sub, message, AES128GCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", sub.Endpoint, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result.Apply(req)
+	if req.Header.Get("Content-Encoding") != "aes128gcm" {
+		t.Errorf("Expected Content-Encoding header to be aes128gcm, got %v", req.Header.Get("Content-Encoding"))
+	}
+	if req.Header.Get("Crypto-Key") != "" || req.Header.Get("Encryption") != "" {
+		t.Errorf("Expected no Crypto-Key or Encryption header for aes128gcm, got %v", req.Header)
+	}
+	if req.ContentLength != int64(len(result.Ciphertext)) {
+		t.Errorf("Expected content length %d, got %d", len(result.Ciphertext), req.ContentLength)
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != string(result.Ciphertext) {
+		t.Error("Expected the request body to be the ciphertext")
+	}
+}
+
+func TestPushRequestOptions(t *testing.T) {
+	sub := &Subscription{Endpoint: "https://example.com/"}
+
+	req, err := NewPushRequestWithOptions(sub, "", &Options{TTL: 3600, Urgency: UrgencyHigh, Topic: "news_1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Header.Get("TTL") != "3600" {
+		t.Errorf("Expected TTL header to be 3600, got %v", req.Header.Get("TTL"))
+	}
+	if req.Header.Get("Urgency") != "high" {
+		t.Errorf("Expected Urgency header to be high, got %v", req.Header.Get("Urgency"))
+	}
+	if req.Header.Get("Topic") != "news_1" {
+		t.Errorf("Expected Topic header to be news_1, got %v", req.Header.Get("Topic"))
+	}
+
+	for _, opts := range []*Options{
+		{TTL: -1},
+		{Urgency: "urgent"},
+		{Topic: "not a topic"},
+		{Topic: strings.Repeat("a", 33)},
+	} {
+		if _, err := NewPushRequestWithOptions(sub, "", opts); err == nil {
+			t.Errorf("Expected an error for options %+v", opts)
+		}
+	}
+}
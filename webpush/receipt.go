@@ -0,0 +1,147 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webpush
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Receipt confirms that a push message was delivered to the user agent.
+type Receipt struct {
+	// Message is the push message resource the receipt is for, which matches
+	// Result.Location.
+	Message string `json:"message"`
+}
+
+// ReceiptSubscription is a subscription to delivery receipts, as described in
+// section 5.1 of RFC 8030. Request a receipt for a message by setting
+// Options.ReceiptURI to URI.
+//
+// RFC 8030 delivers receipts using HTTP/2 server push, which Go's HTTP client
+// doesn't support. Instead the receipt subscription resource is polled with
+// GET requests, to which the push service replies with 204 No Content if no
+// receipts arrived before it timed out, or 200 OK and a stream of JSON encoded
+// Receipt objects that it writes as they arrive.
+type ReceiptSubscription struct {
+	// URI is the receipt subscription resource.
+	URI string
+	// Client is used to poll for receipts. If nil, http.DefaultClient is used.
+	Client *http.Client
+	// PollInterval is the least time between the start of one poll and the
+	// next, so that Listen doesn't poll continually if the push service
+	// answers without waiting for receipts. If zero,
+	// DefaultReceiptPollInterval is used.
+	PollInterval time.Duration
+}
+
+// DefaultReceiptPollInterval is the least time between polls for receipts,
+// unless a ReceiptSubscription's PollInterval is set.
+const DefaultReceiptPollInterval = time.Second
+
+// NewReceiptSubscription creates a receipt subscription by POSTing to the
+// receipt subscribe resource of a push service. User agents learn this from
+// the Link header with relation type "urn:ietf:params:push:receipt" when they
+// subscribe, and must pass it on to the application server.
+func NewReceiptSubscription(ctx context.Context, client *http.Client, subscribeURI string) (*ReceiptSubscription, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequest("POST", subscribeURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("receipt subscribe resource returned %s", resp.Status)
+	}
+	loc, err := resp.Location()
+	if err != nil {
+		return nil, fmt.Errorf("receipt subscribe resource returned no receipt subscription: %v", err)
+	}
+	return &ReceiptSubscription{URI: loc.String(), Client: client}, nil
+}
+
+// Listen polls for receipts and calls fn for each one, until ctx is done or
+// the push service returns an error, for example because the receipt
+// subscription expired.
+func (s *ReceiptSubscription) Listen(ctx context.Context, fn func(*Receipt)) error {
+	interval := s.PollInterval
+	if interval == 0 {
+		interval = DefaultReceiptPollInterval
+	}
+	for {
+		next := time.NewTimer(interval)
+		if err := s.poll(ctx, fn); err != nil {
+			next.Stop()
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		select {
+		case <-next.C:
+		case <-ctx.Done():
+			next.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *ReceiptSubscription) poll(ctx context.Context, fn func(*Receipt)) error {
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequest("GET", s.URI, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNoContent:
+		return nil
+	default:
+		return fmt.Errorf("receipt subscription returned %s", resp.Status)
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var r Receipt
+		if err := dec.Decode(&r); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		fn(&r)
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webpush_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/googlechrome/push-encryption-go/webpush"
+	"github.com/googlechrome/push-encryption-go/webpush/webpushtest"
+)
+
+// testSubscription returns a subscription with the keys from the internal
+// tests, pointing at the push resource name on the simulator.
+func testSubscription(t *testing.T, s *webpushtest.Server, name string) *webpush.Subscription {
+	sub, err := webpush.SubscriptionFromJSON([]byte(`{
+		"endpoint": "https://example.com/",
+		"keys": {
+			"p256dh": "BCXJI0VW7evda9ldlo18MuHhgQVxWbd0dGmUfpQedaD7KDjB8sGWX5iiP7lkjxi-A02b8Fi3BMWWLoo3b4Tdl-c=",
+			"auth": "WPF9D0bTVZCV2pXSgj6Zug=="
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub.Endpoint = s.Endpoint(name)
+	return sub
+}
+
+func TestReceipts(t *testing.T) {
+	s := webpushtest.NewServer()
+	defer s.Close()
+	s.LongPollTimeout = 50 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rs, err := webpush.NewReceiptSubscription(ctx, nil, s.ReceiptSubscribeURI())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub := testSubscription(t, s, "device")
+	result, err := webpush.SendWithOptions(nil, sub, "I am the walrus", &webpush.Options{ReceiptURI: rs.URI})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.StatusCode != 201 {
+		t.Fatalf("Expected 201 Created, got %d %s", result.StatusCode, result.Body)
+	}
+	if result.Location == "" {
+		t.Fatal("Expected the push message resource in Location")
+	}
+
+	m := s.Messages()[0]
+	if m.Header.Get("Prefer") != "respond-async" {
+		t.Errorf("Expected Prefer header to be respond-async, got %v", m.Header.Get("Prefer"))
+	}
+	if m.Header.Get("Push-Receipt") != rs.URI {
+		t.Errorf("Expected Push-Receipt header to be %v, got %v", rs.URI, m.Header.Get("Push-Receipt"))
+	}
+
+	receipts := make(chan *webpush.Receipt)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- rs.Listen(ctx, func(r *webpush.Receipt) { receipts <- r })
+	}()
+
+	// Let at least one long poll time out before the message is delivered.
+	time.Sleep(80 * time.Millisecond)
+	if err := s.Acknowledge(result.Location); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case r := <-receipts:
+		if r.Message != result.Location {
+			t.Errorf("Receipt was for %v, expected %v", r.Message, result.Location)
+		}
+	case err := <-errc:
+		t.Fatalf("Listen returned early: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a receipt")
+	}
+
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("Expected Listen to return context.Canceled, got %v", err)
+	}
+}
+
+func TestReceiptUnknownSubscription(t *testing.T) {
+	s := webpushtest.NewServer()
+	defer s.Close()
+
+	sub := testSubscription(t, s, "device")
+	result, err := webpush.SendWithOptions(nil, sub, "", &webpush.Options{ReceiptURI: s.URL + "/receipts/nope"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.StatusCode != 400 {
+		t.Errorf("Expected 400 for an unknown receipt subscription, got %d", result.StatusCode)
+	}
+	if result.ServiceError == nil || result.ServiceError.Message != "unknown receipt subscription" {
+		t.Errorf("Expected the push service's error message, got %v", result.ServiceError)
+	}
+
+	rs := &webpush.ReceiptSubscription{URI: s.URL + "/receipts/nope"}
+	if err := rs.Listen(context.Background(), func(*webpush.Receipt) {}); err == nil {
+		t.Error("Expected an error listening to an unknown receipt subscription")
+	}
+}
+
+func TestReceiptPollInterval(t *testing.T) {
+	var polls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&polls, 1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	rs := &webpush.ReceiptSubscription{URI: ts.URL, PollInterval: 100 * time.Millisecond}
+	if err := rs.Listen(ctx, func(*webpush.Receipt) {}); err != context.DeadlineExceeded {
+		t.Errorf("Expected Listen to return context.DeadlineExceeded, got %v", err)
+	}
+	if n := atomic.LoadInt32(&polls); n < 2 || n > 3 {
+		t.Errorf("Expected 2 or 3 polls in 250ms, got %d", n)
+	}
+}
@@ -0,0 +1,319 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webpush
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/googlechrome/push-encryption-go/ece"
+)
+
+// ErrContentNotFound is returned by a ContentStore when it has no content for
+// a token.
+var ErrContentNotFound = errors.New("content not found")
+
+// DefaultContentLifetime is how long a ContentServer keeps content, unless
+// its Lifetime is set.
+const DefaultContentLifetime = 24 * time.Hour
+
+// Reference is the payload of a push message whose content is too large to
+// push, and is instead fetched from the application server.
+type Reference struct {
+	// URL is where the content can be fetched from with a GET request. It
+	// includes a random token, so it must be kept secret.
+	URL string `json:"url"`
+	// ContentType is the media type of the content.
+	ContentType string `json:"type,omitempty"`
+	// Length is the length of the content in bytes, before any encryption.
+	Length int `json:"length"`
+	// Key is set if the content is encrypted with aes128gcm (RFC 8188), using
+	// Key as the input keying material. It is random for each message and
+	// only travels inside the encrypted push message, so only the user agent
+	// can read the content. It is base64 encoded in JSON.
+	Key []byte `json:"key,omitempty"`
+}
+
+// The JSON encoding of a push message carrying a Reference.
+type referencePayload struct {
+	Reference *Reference `json:"web_push_reference"`
+}
+
+// ParseReference decodes the payload of a push message sent by
+// ContentServer.Payload.
+func ParseReference(payload []byte) (*Reference, error) {
+	var p referencePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return nil, err
+	}
+	if p.Reference == nil || p.Reference.URL == "" {
+		return nil, errors.New("payload is not a reference")
+	}
+	return p.Reference, nil
+}
+
+// StoredContent is the content of a message sent by reference.
+type StoredContent struct {
+	Body        []byte
+	ContentType string
+	Encrypted   bool
+	Expires     time.Time
+}
+
+// ContentStore holds the content of messages sent by reference.
+type ContentStore interface {
+	// PutContent stores the content under the token.
+	PutContent(ctx context.Context, token string, c *StoredContent) error
+	// Content returns the content stored under the token, or
+	// ErrContentNotFound.
+	Content(ctx context.Context, token string) (*StoredContent, error)
+}
+
+// MemoryContentStore is a ContentStore that keeps content in memory.
+type MemoryContentStore struct {
+	mu      sync.Mutex
+	content map[string]*StoredContent
+}
+
+// NewMemoryContentStore returns an empty MemoryContentStore.
+func NewMemoryContentStore() *MemoryContentStore {
+	return &MemoryContentStore{content: make(map[string]*StoredContent)}
+}
+
+// PutContent implements ContentStore.
+func (m *MemoryContentStore) PutContent(ctx context.Context, token string, c *StoredContent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.content[token] = c
+	return nil
+}
+
+// Content implements ContentStore.
+func (m *MemoryContentStore) Content(ctx context.Context, token string) (*StoredContent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.content[token]
+	if !ok {
+		return nil, ErrContentNotFound
+	}
+	return c, nil
+}
+
+// DeleteExpired removes the content that expired before now.
+func (m *MemoryContentStore) DeleteExpired(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for token, c := range m.content {
+		if c.Expires.Before(now) {
+			delete(m.content, token)
+		}
+	}
+}
+
+// ContentServer sends content that is too large for a push message by
+// reference: Payload stores the content and returns a small payload with the
+// URL it can be fetched from, which the service worker fetches from
+// ContentServer's ServeHTTP method.
+//
+// The content is protected by the secrecy of the URL, which only travels
+// inside the encrypted push message, so BaseURL must use https. With EndToEnd
+// set the content is also encrypted with a random key that is sent in the
+// Reference, so that it can only be read by the user agent, even if the store
+// or the URL is exposed. A service worker can decrypt it with WebCrypto; see
+// the README.
+type ContentServer struct {
+	Store ContentStore
+	// BaseURL is the absolute URL that ServeHTTP is reached at, which the
+	// token of each message is added to as a final path segment. A trailing
+	// slash is assumed if it is missing.
+	BaseURL string
+	// Lifetime is how long content can be fetched for. If zero,
+	// DefaultContentLifetime is used. It should be at least the TTL of the
+	// push message.
+	Lifetime time.Duration
+	// EndToEnd encrypts content with a key sent in the Reference.
+	EndToEnd bool
+	// Now returns the current time. If nil, time.Now is used.
+	Now func() time.Time
+}
+
+// NewContentServer returns a ContentServer that serves content from the store
+// at baseURL.
+func NewContentServer(store ContentStore, baseURL string) *ContentServer {
+	return &ContentServer{Store: store, BaseURL: baseURL}
+}
+
+func (s *ContentServer) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
+
+// Payload stores the content and returns the push message payload that refers
+// to it.
+func (s *ContentServer) Payload(ctx context.Context, content []byte, contentType string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	contentURL, err := s.contentURL(token)
+	if err != nil {
+		return "", err
+	}
+
+	lifetime := s.Lifetime
+	if lifetime == 0 {
+		lifetime = DefaultContentLifetime
+	}
+	ref := &Reference{
+		URL:         contentURL,
+		ContentType: contentType,
+		Length:      len(content),
+	}
+	stored := &StoredContent{
+		Body:        content,
+		ContentType: contentType,
+		Encrypted:   s.EndToEnd,
+		Expires:     s.now().Add(lifetime),
+	}
+	if s.EndToEnd {
+		ref.Key = make([]byte, 16)
+		if _, err := rand.Read(ref.Key); err != nil {
+			return "", err
+		}
+		if stored.Body, err = ece.Encrypt(content, ref.Key, nil, ece.DefaultRecordSize, nil); err != nil {
+			return "", err
+		}
+	}
+	if err := s.Store.PutContent(ctx, token, stored); err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(referencePayload{ref})
+	if err != nil {
+		return "", err
+	}
+	return string(payload), nil
+}
+
+// contentURL returns the URL that ServeHTTP serves a token's content at.
+func (s *ContentServer) contentURL(token string) (string, error) {
+	u, err := url.Parse(s.BaseURL)
+	if err != nil {
+		return "", err
+	}
+	if !u.IsAbs() || u.Host == "" {
+		return "", fmt.Errorf("content server BaseURL %q is not an absolute URL", s.BaseURL)
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+		u.RawPath = ""
+	}
+	return u.ResolveReference(&url.URL{Path: token}).String(), nil
+}
+
+// ServeHTTP serves GET requests for the content of a token, which is the last
+// segment of the path.
+func (s *ContentServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	c, err := s.Store.Content(r.Context(), path.Base(r.URL.Path))
+	if err == ErrContentNotFound || err == nil && !s.now().Before(c.Expires) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Length", strconv.Itoa(len(c.Body)))
+	if c.Encrypted {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Encoding", AES128GCM.String())
+	} else if c.ContentType != "" {
+		w.Header().Set("Content-Type", c.ContentType)
+	}
+	w.Write(c.Body)
+}
+
+// FetchReference fetches the content of a reference, as a user agent would,
+// decrypting it with the reference's key if it has one. If the client is nil,
+// http.DefaultClient is used.
+func FetchReference(ctx context.Context, client *http.Client, ref *Reference) ([]byte, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequest("GET", ref.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Stop the transport from asking for gzip, as the content may be
+	// encrypted.
+	req.Header.Set("Accept-Encoding", "identity")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching referenced content returned %s", resp.Status)
+	}
+	limit := int64(ref.Length)
+	if ref.Key != nil {
+		// Allow for the header and the tag and delimiter of each record.
+		records := ref.Length/(ece.DefaultRecordSize-gcmTagSize-1) + 1
+		limit += int64(aes128gcmHeaderPrefixLength + ece.MaxKeyIDLength + records*(gcmTagSize+1))
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if ref.Key != nil {
+		body, err = ece.Decrypt(body, func([]byte) ([]byte, error) {
+			return ref.Key, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(body) != ref.Length {
+		return nil, fmt.Errorf("referenced content is %d bytes, expected %d", len(body), ref.Length)
+	}
+	return body, nil
+}
@@ -0,0 +1,219 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webpush
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestContentServer(t *testing.T) (*ContentServer, *MemoryContentStore, *httptest.Server) {
+	store := NewMemoryContentStore()
+	cs := NewContentServer(store, "")
+	mux := http.NewServeMux()
+	mux.Handle("/content/", cs)
+	ts := httptest.NewServer(mux)
+	cs.BaseURL = ts.URL + "/content/"
+	return cs, store, ts
+}
+
+func TestContentServer(t *testing.T) {
+	cs, _, ts := newTestContentServer(t)
+	defer ts.Close()
+
+	ctx := context.Background()
+	sub, _ := newTestKeys(t)
+	content := bytes.Repeat([]byte("chat message with a preview "), 1000)
+	payload, err := cs.Payload(ctx, content, "application/json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Encrypt(sub, payload, AES128GCM); err != nil {
+		t.Errorf("Expected the reference to fit in a push message: %v", err)
+	}
+
+	ref, err := ParseReference([]byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(ref.URL, cs.BaseURL) || ref.Length != len(content) || ref.ContentType != "application/json" || ref.Key != nil {
+		t.Errorf("Unexpected reference %+v", ref)
+	}
+
+	resp, err := http.Get(ref.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "application/json" || resp.Header.Get("Cache-Control") != "no-store" {
+		t.Errorf("Unexpected headers %v", resp.Header)
+	}
+
+	fetched, err := FetchReference(ctx, nil, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fetched, content) {
+		t.Error("Fetched content does not match")
+	}
+
+	resp, err = http.Post(ref.URL, "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for POST, got %d", resp.StatusCode)
+	}
+
+	missing := *ref
+	missing.URL = cs.BaseURL + "nope"
+	if _, err := FetchReference(ctx, nil, &missing); err == nil {
+		t.Error("Expected an error fetching an unknown token")
+	}
+}
+
+func TestContentServerBaseURL(t *testing.T) {
+	cs, _, ts := newTestContentServer(t)
+	defer ts.Close()
+	ctx := context.Background()
+
+	cs.BaseURL = ts.URL + "/content"
+	payload, err := cs.Payload(ctx, []byte("hello"), "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := ParseReference([]byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(ref.URL, ts.URL+"/content/") {
+		t.Errorf("Expected the URL to be under %s/content/, got %s", ts.URL, ref.URL)
+	}
+	fetched, err := FetchReference(ctx, nil, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(fetched) != "hello" {
+		t.Errorf("Expected hello, got %q", fetched)
+	}
+
+	cs.BaseURL = "/content/"
+	if _, err := cs.Payload(ctx, []byte("hello"), "text/plain"); err == nil {
+		t.Error("Expected an error for a relative BaseURL")
+	}
+}
+
+func TestContentServerEndToEnd(t *testing.T) {
+	cs, store, ts := newTestContentServer(t)
+	defer ts.Close()
+	cs.EndToEnd = true
+
+	ctx := context.Background()
+	sub, _ := newTestKeys(t)
+	content := bytes.Repeat([]byte("secret "), 3000)
+	payload, err := cs.Payload(ctx, content, "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Encrypt(sub, payload, AES128GCM); err != nil {
+		t.Errorf("Expected the reference to fit in a push message: %v", err)
+	}
+	ref, err := ParseReference([]byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ref.Key) != 16 {
+		t.Fatalf("Expected a 16 byte key, got %v", ref.Key)
+	}
+
+	stored, err := store.Content(ctx, ref.URL[len(cs.BaseURL):])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stored.Body, []byte("secret")) {
+		t.Error("Expected the stored content to be encrypted")
+	}
+
+	fetched, err := FetchReference(ctx, nil, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fetched, content) {
+		t.Error("Decrypted content does not match")
+	}
+
+	other, err := ParseReference([]byte(mustPayload(t, cs, content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(other.Key, ref.Key) {
+		t.Error("Expected each message to have its own key")
+	}
+	wrong := *ref
+	wrong.Key = other.Key
+	if _, err := FetchReference(ctx, nil, &wrong); err == nil {
+		t.Error("Expected an error decrypting with another message's key")
+	}
+	keyless := *ref
+	keyless.Key = nil
+	if _, err := FetchReference(ctx, nil, &keyless); err == nil {
+		t.Error("Expected an error fetching encrypted content without the key")
+	}
+}
+
+func mustPayload(t *testing.T, cs *ContentServer, content []byte) string {
+	payload, err := cs.Payload(context.Background(), content, "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func TestContentServerExpiry(t *testing.T) {
+	cs, store, ts := newTestContentServer(t)
+	defer ts.Close()
+	now := time.Now()
+	cs.Now = func() time.Time { return now }
+	cs.Lifetime = time.Hour
+
+	ctx := context.Background()
+	payload, err := cs.Payload(ctx, []byte("hello"), "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := ParseReference([]byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(time.Hour)
+	if _, err := FetchReference(ctx, nil, ref); err == nil {
+		t.Error("Expected an error fetching expired content")
+	}
+	store.DeleteExpired(now.Add(time.Second))
+	if _, err := store.Content(ctx, ref.URL[len(cs.BaseURL):]); err != ErrContentNotFound {
+		t.Errorf("Expected the expired content to be deleted, got %v", err)
+	}
+
+	if _, err := ParseReference([]byte(`{"title": "Hi"}`)); err == nil {
+		t.Error("Expected an error parsing a payload that isn't a reference")
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webpush
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"time"
+)
+
+// ErrInvalidPayloadSignature is returned by VerifyPayload when a signed payload
+// wasn't signed by the expected key for the subscription.
+var ErrInvalidPayloadSignature = errors.New("payload signature is invalid")
+
+// How far in the future a signed payload's iat may be, to allow for clock skew.
+const maxPayloadClockSkew = time.Minute
+
+// SignedPayload is a message signed by SignPayload. Its JSON encoding is
+//
+//	{"web_push_signed": {"msg": "...", "iat": 1453523768, "sig": "..."}}
+//
+// where sig is the base64url encoded ES256 signature, r followed by s, of
+//
+//	"web_push_signed\n" + endpoint + "\n" + iat + "\n" + msg
+//
+// which a service worker can check with crypto.subtle.verify using the
+// application server's public key and its own subscription's endpoint.
+type SignedPayload struct {
+	// Message is the payload that was signed.
+	Message string `json:"msg"`
+	// IssuedAt is when it was signed, in seconds since the epoch.
+	IssuedAt int64 `json:"iat"`
+	// Signature is the base64url encoded signature.
+	Signature string `json:"sig"`
+}
+
+// The JSON encoding of a push message carrying a SignedPayload.
+type signedPayloadJSON struct {
+	Signed *SignedPayload `json:"web_push_signed"`
+}
+
+// signingInput returns the bytes that are signed. Including the endpoint stops
+// a message signed for one subscription being replayed to another.
+func signingInput(endpoint string, iat int64, message string) []byte {
+	return []byte("web_push_signed\n" + endpoint + "\n" + strconv.FormatInt(iat, 10) + "\n" + message)
+}
+
+// SignPayload wraps the payload in a SignedPayload signed with the VAPID key,
+// for the subscription's endpoint. Encryption only shows that a message was
+// sent by someone who has the subscription, so anyone who learns it can send
+// messages; a signature shows that it came from the application server. Use a
+// VAPID with only a PrivateKey or Signer set to sign with a key other than
+// the VAPID key. Set Options.PayloadSigner to sign messages as they are sent.
+func (v *VAPID) SignPayload(sub *Subscription, payload string) (string, error) {
+	signer, _, err := v.signer()
+	if err != nil {
+		return "", err
+	}
+
+	iat := v.now().Unix()
+	hash := sha256.Sum256(signingInput(sub.Endpoint, iat, payload))
+	der, err := signer.Sign(rand.Reader, hash[:], crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+	sig, err := joseSignature(der)
+	if err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(signedPayloadJSON{&SignedPayload{
+		Message:   payload,
+		IssuedAt:  iat,
+		Signature: base64.RawURLEncoding.EncodeToString(sig),
+	}})
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// VerifyPayload checks that a decrypted payload was signed by SignPayload with
+// the private key of publicKey, an uncompressed P-256 point, for the
+// endpoint, and returns the message that was signed. If maxAge is more than
+// zero, payloads signed longer ago than that are rejected too.
+func VerifyPayload(payload []byte, endpoint string, publicKey []byte, maxAge time.Duration) (string, error) {
+	return (&VAPIDVerifier{}).VerifyPayload(payload, endpoint, publicKey, maxAge)
+}
+
+// VerifyPayload is like the VerifyPayload function, checking the age of the
+// payload against v's clock.
+func (v *VAPIDVerifier) VerifyPayload(payload []byte, endpoint string, publicKey []byte, maxAge time.Duration) (string, error) {
+	var p signedPayloadJSON
+	if err := json.Unmarshal(payload, &p); err != nil || p.Signed == nil {
+		return "", errors.New("payload is not signed")
+	}
+	s := p.Signed
+
+	x, y := elliptic.Unmarshal(curve, publicKey)
+	if x == nil {
+		return "", errors.New("public key is not an uncompressed P-256 point")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(s.Signature)
+	if err != nil || len(sig) != 64 {
+		return "", ErrInvalidPayloadSignature
+	}
+	hash := sha256.Sum256(signingInput(endpoint, s.IssuedAt, s.Message))
+	r, ss := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(&ecdsa.PublicKey{Curve: curve, X: x, Y: y}, hash[:], r, ss) {
+		return "", ErrInvalidPayloadSignature
+	}
+
+	iat := time.Unix(s.IssuedAt, 0)
+	now := v.now()
+	if iat.After(now.Add(maxPayloadClockSkew)) {
+		return "", fmt.Errorf("payload was signed in the future, at %v", iat.UTC())
+	}
+	if maxAge > 0 && now.Sub(iat) > maxAge {
+		return "", fmt.Errorf("payload was signed at %v, more than %v ago", iat.UTC(), maxAge)
+	}
+	return s.Message, nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webpush
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestSignedPayload(t *testing.T) {
+	v := newTestVAPID(t)
+	sub, priv := newTestKeys(t)
+
+	req, err := NewPushRequestWithOptions(sub, "Hello", &Options{VAPID: v, PayloadSigner: v})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := ParseEncryptionResult(req.Header, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := Decrypt(sub, priv, result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message, err := VerifyPayload(payload, sub.Endpoint, v.PublicKey(), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message != "Hello" {
+		t.Errorf("Expected Hello, got %q", message)
+	}
+
+	if _, err := VerifyPayload(payload, "https://example.com/other", v.PublicKey(), 0); err != ErrInvalidPayloadSignature {
+		t.Errorf("Expected a signature for another endpoint to be rejected, got %v", err)
+	}
+	if _, err := VerifyPayload(payload, sub.Endpoint, newTestVAPID(t).PublicKey(), 0); err != ErrInvalidPayloadSignature {
+		t.Errorf("Expected a signature by another key to be rejected, got %v", err)
+	}
+
+	var p signedPayloadJSON
+	if err := json.Unmarshal(payload, &p); err != nil {
+		t.Fatal(err)
+	}
+	p.Signed.Message = "Goodbye"
+	forged, _ := json.Marshal(p)
+	if _, err := VerifyPayload(forged, sub.Endpoint, v.PublicKey(), 0); err != ErrInvalidPayloadSignature {
+		t.Errorf("Expected a changed message to be rejected, got %v", err)
+	}
+
+	if _, err := VerifyPayload([]byte("Hello"), sub.Endpoint, v.PublicKey(), 0); err == nil {
+		t.Error("Expected an unsigned payload to be rejected")
+	}
+}
+
+func TestSignedPayloadAge(t *testing.T) {
+	key, err := GenerateVAPIDKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1453523768, 0)
+	signer := &VAPID{PrivateKey: key, Now: func() time.Time { return now }}
+	sub := &Subscription{Endpoint: "https://push.example.net/push/a"}
+
+	payload, err := signer.SignPayload(sub, "Hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier := &VAPIDVerifier{Now: signer.Now}
+	now = now.Add(time.Hour)
+	if _, err := verifier.VerifyPayload([]byte(payload), sub.Endpoint, signer.PublicKey(), 0); err != nil {
+		t.Errorf("Expected no age limit, got %v", err)
+	}
+	if _, err := verifier.VerifyPayload([]byte(payload), sub.Endpoint, signer.PublicKey(), time.Minute); err == nil {
+		t.Error("Expected an old payload to be rejected")
+	}
+
+	now = now.Add(-2 * time.Hour)
+	if _, err := verifier.VerifyPayload([]byte(payload), sub.Endpoint, signer.PublicKey(), 0); err == nil {
+		t.Error("Expected a payload from the future to be rejected")
+	}
+}
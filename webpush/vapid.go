@@ -0,0 +1,519 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webpush
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The longest a VAPID token may be valid for. See section 2 of RFC 8292.
+	maxVAPIDLifetime = 24 * time.Hour
+	// DefaultVAPIDLifetime is how long tokens are valid for, unless
+	// VAPID.Lifetime is set.
+	DefaultVAPIDLifetime = 12 * time.Hour
+)
+
+var (
+	// The JWT header of every VAPID token.
+	vapidJWTHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`))
+
+	// The current time, overridable for testing.
+	timeNow = time.Now
+)
+
+// VAPID identifies an application server to push services, using the
+// Voluntary Application Server Identification scheme described in RFC 8292.
+// Set Options.VAPID to sign push requests.
+//
+// There are only a handful of push services, so rather than signing a token
+// for every message, a token is signed for each push service origin and
+// reused until half of its lifetime has passed. A VAPID is safe for
+// concurrent use, but its fields must not be changed once it has been used.
+type VAPID struct {
+	// PrivateKey signs the tokens. Its public key is the applicationServerKey
+	// that the browser was given when subscribing.
+	PrivateKey *ecdsa.PrivateKey
+	// Signer is used instead of PrivateKey if set, so that the key can be
+	// kept in a KMS or hardware token. Its public key must be a P-256
+	// *ecdsa.PublicKey, and it must return ASN.1 encoded ECDSA signatures as
+	// ecdsa.PrivateKey does.
+	Signer crypto.Signer
+	// Subject is a mailto: or https: URI that the push service can use to
+	// contact the operator of the application server.
+	Subject string
+	// Lifetime is how long tokens are valid for, at most 24 hours. If zero,
+	// DefaultVAPIDLifetime is used.
+	Lifetime time.Duration
+	// Now returns the current time. If nil, time.Now is used.
+	Now func() time.Time
+	// Draft uses the older scheme of draft-ietf-webpush-vapid-01, which some
+	// push services still expect: the token is sent as "WebPush <token>" and
+	// the public key in the p256ecdsa parameter of the Crypto-Key header.
+	Draft bool
+
+	mu     sync.Mutex
+	tokens map[string]vapidToken
+}
+
+// A signed token and when it should be replaced.
+type vapidToken struct {
+	token   string
+	refresh time.Time
+}
+
+// GenerateVAPIDKey generates a new key pair for use with VAPID.
+func GenerateVAPIDKey() (*ecdsa.PrivateKey, error) {
+	return ecdsa.GenerateKey(curve, rand.Reader)
+}
+
+// PublicKey returns the public key in the uncompressed form that browsers
+// expect as the applicationServerKey, or nil if there is no P-256 key.
+func (v *VAPID) PublicKey() []byte {
+	_, pub, err := v.signer()
+	if err != nil {
+		return nil
+	}
+	return elliptic.Marshal(curve, pub.X, pub.Y)
+}
+
+func (v *VAPID) now() time.Time {
+	if v.Now != nil {
+		return v.Now()
+	}
+	return timeNow()
+}
+
+// signer returns the signer of the tokens and its public key.
+func (v *VAPID) signer() (crypto.Signer, *ecdsa.PublicKey, error) {
+	signer := v.Signer
+	if signer == nil {
+		if v.PrivateKey == nil {
+			return nil, nil, errors.New("VAPID has no private key")
+		}
+		signer = v.PrivateKey
+	}
+	pub, ok := signer.Public().(*ecdsa.PublicKey)
+	if !ok || pub.Curve != curve {
+		return nil, nil, errors.New("VAPID private key must be a P-256 key")
+	}
+	return signer, pub, nil
+}
+
+// ApplyHeaders sets the headers that identify the application server in a
+// push request to the given endpoint. With Draft set the public key is added
+// to any Crypto-Key header already present.
+func (v *VAPID) ApplyHeaders(h http.Header, endpoint string) error {
+	auth, err := v.AuthorizationHeader(endpoint)
+	if err != nil {
+		return err
+	}
+	h.Set("Authorization", auth)
+	if v.Draft {
+		setHeaderParam(h, "Crypto-Key", "p256ecdsa", base64.RawURLEncoding.EncodeToString(v.PublicKey()))
+	}
+	return nil
+}
+
+// AuthorizationHeader returns the value of the Authorization header for a
+// push request to the given endpoint. With Draft set the public key must also
+// be sent in the Crypto-Key header, which ApplyHeaders does.
+func (v *VAPID) AuthorizationHeader(endpoint string) (string, error) {
+	token, err := v.Token(endpoint)
+	if err != nil {
+		return "", err
+	}
+	if v.Draft {
+		return "WebPush " + token, nil
+	}
+	k := base64.RawURLEncoding.EncodeToString(v.PublicKey())
+	return fmt.Sprintf("vapid t=%s, k=%s", token, k), nil
+}
+
+// Token returns a signed JWT for the origin of the endpoint, reusing an
+// earlier one if it is less than half way through its lifetime.
+func (v *VAPID) Token(endpoint string) (string, error) {
+	aud, err := origin(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	now := v.now()
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if t, ok := v.tokens[aud]; ok && now.Before(t.refresh) {
+		return t.token, nil
+	}
+
+	lifetime := v.Lifetime
+	if lifetime == 0 {
+		lifetime = DefaultVAPIDLifetime
+	}
+	if lifetime < 0 || lifetime > maxVAPIDLifetime {
+		return "", fmt.Errorf("VAPID token lifetime must be at most 24 hours, was %v", lifetime)
+	}
+
+	token, err := v.sign(aud, now.Add(lifetime))
+	if err != nil {
+		return "", err
+	}
+	if v.tokens == nil {
+		v.tokens = make(map[string]vapidToken)
+	}
+	v.tokens[aud] = vapidToken{token, now.Add(lifetime / 2)}
+	return token, nil
+}
+
+// sign returns a new token for the audience.
+func (v *VAPID) sign(aud string, exp time.Time) (string, error) {
+	signer, _, err := v.signer()
+	if err != nil {
+		return "", err
+	}
+	if err := validVAPIDSubject(v.Subject); err != nil {
+		return "", err
+	}
+
+	claims, err := json.Marshal(vapidClaims{
+		Audience: aud,
+		Expires:  exp.Unix(),
+		Subject:  v.Subject,
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := vapidJWTHeader + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	hash := sha256.Sum256([]byte(unsigned))
+	der, err := signer.Sign(rand.Reader, hash[:], crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+	sig, err := joseSignature(der)
+	if err != nil {
+		return "", err
+	}
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// An ASN.1 encoded ECDSA signature.
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// joseSignature converts an ASN.1 encoded P-256 signature to the fixed size
+// concatenation of r and s that JWS uses.
+func joseSignature(der []byte) ([]byte, error) {
+	var es ecdsaSignature
+	rest, err := asn1.Unmarshal(der, &es)
+	if err != nil {
+		return nil, fmt.Errorf("malformed ECDSA signature: %v", err)
+	}
+	if len(rest) > 0 || es.R == nil || es.S == nil || es.R.Sign() <= 0 || es.S.Sign() <= 0 {
+		return nil, errors.New("malformed ECDSA signature")
+	}
+	rb, sb := es.R.Bytes(), es.S.Bytes()
+	if len(rb) > 32 || len(sb) > 32 {
+		return nil, errors.New("ECDSA signature is not a P-256 signature")
+	}
+	sig := make([]byte, 64)
+	copy(sig[32-len(rb):32], rb)
+	copy(sig[64-len(sb):], sb)
+	return sig, nil
+}
+
+// The claims of a VAPID token.
+type vapidClaims struct {
+	Audience string `json:"aud"`
+	Expires  int64  `json:"exp"`
+	Subject  string `json:"sub,omitempty"`
+}
+
+// VAPIDClaims are the claims of a verified VAPID token.
+type VAPIDClaims struct {
+	// Audience is the origin of the push service.
+	Audience string
+	Expires  time.Time
+	// Subject is the contact URI of the application server.
+	Subject string
+	// PublicKey is the application server key that signed the token.
+	PublicKey []byte
+}
+
+// VAPIDErrorCode says why a VAPID token was rejected.
+type VAPIDErrorCode int
+
+// The reasons a VAPID token can be rejected.
+const (
+	// VAPIDMissing means the request had no VAPID Authorization header.
+	VAPIDMissing VAPIDErrorCode = iota
+	// VAPIDMalformed means the header or token couldn't be parsed.
+	VAPIDMalformed
+	// VAPIDInvalidKey means the k parameter isn't a P-256 public key.
+	VAPIDInvalidKey
+	// VAPIDInvalidSignature means the token wasn't signed by the key.
+	VAPIDInvalidSignature
+	// VAPIDWrongAudience means the aud claim isn't the push service's origin.
+	VAPIDWrongAudience
+	// VAPIDExpired means the exp claim is in the past.
+	VAPIDExpired
+	// VAPIDExpiryTooLate means the exp claim is more than 24 hours away.
+	VAPIDExpiryTooLate
+	// VAPIDInvalidSubject means the sub claim isn't a mailto: or https: URI.
+	VAPIDInvalidSubject
+)
+
+func (c VAPIDErrorCode) String() string {
+	switch c {
+	case VAPIDMissing:
+		return "missing"
+	case VAPIDMalformed:
+		return "malformed"
+	case VAPIDInvalidKey:
+		return "invalid key"
+	case VAPIDInvalidSignature:
+		return "invalid signature"
+	case VAPIDWrongAudience:
+		return "wrong audience"
+	case VAPIDExpired:
+		return "expired"
+	case VAPIDExpiryTooLate:
+		return "expiry too late"
+	case VAPIDInvalidSubject:
+		return "invalid subject"
+	}
+	return "unknown"
+}
+
+// VAPIDError is returned by VerifyVAPID when a token is rejected.
+type VAPIDError struct {
+	Code   VAPIDErrorCode
+	Detail string
+}
+
+func (e *VAPIDError) Error() string {
+	return fmt.Sprintf("VAPID token rejected (%s): %s", e.Code, e.Detail)
+}
+
+func vapidError(code VAPIDErrorCode, format string, args ...interface{}) error {
+	return &VAPIDError{code, fmt.Sprintf(format, args...)}
+}
+
+// VerifyVAPID verifies the VAPID Authorization header of a push request, as a
+// push service would. The aud claim must match the origin of the request,
+// which for a request received by a server is taken from its Host header and
+// whether it was made over TLS. Both the vapid scheme and the WebPush scheme
+// of the earlier drafts are accepted. Errors are of type *VAPIDError.
+func VerifyVAPID(req *http.Request) (*VAPIDClaims, error) {
+	return (&VAPIDVerifier{}).Verify(req)
+}
+
+// VerifyVAPIDHeaders is like VerifyVAPID, for the headers of a push request and
+// the origin that the aud claim must match. Use it when the origin of the
+// request isn't known to the server, such as behind a proxy.
+func VerifyVAPIDHeaders(h http.Header, audience string) (*VAPIDClaims, error) {
+	return (&VAPIDVerifier{}).VerifyHeaders(h, audience)
+}
+
+// VerifyVAPIDHeader verifies the value of an Authorization header that uses
+// the vapid scheme of RFC 8292, for the origin that the aud claim must match.
+func VerifyVAPIDHeader(authorization, audience string) (*VAPIDClaims, error) {
+	return (&VAPIDVerifier{}).VerifyHeader(authorization, audience)
+}
+
+// VAPIDVerifier verifies VAPID tokens against its own clock, such as the
+// clock given to the VAPID that signed them. The VerifyVAPID functions use a
+// VAPIDVerifier with the system clock.
+type VAPIDVerifier struct {
+	// Now returns the current time. If nil, time.Now is used.
+	Now func() time.Time
+}
+
+func (v *VAPIDVerifier) now() time.Time {
+	if v.Now != nil {
+		return v.Now()
+	}
+	return timeNow()
+}
+
+// Verify is like VerifyVAPID.
+func (v *VAPIDVerifier) Verify(req *http.Request) (*VAPIDClaims, error) {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	host := req.Host
+	if req.URL.IsAbs() {
+		scheme, host = req.URL.Scheme, req.URL.Host
+	}
+	return v.VerifyHeaders(req.Header, scheme+"://"+host)
+}
+
+// VerifyHeaders is like VerifyVAPIDHeaders.
+func (v *VAPIDVerifier) VerifyHeaders(h http.Header, audience string) (*VAPIDClaims, error) {
+	authorization := h.Get("Authorization")
+	fields := strings.SplitN(authorization, " ", 2)
+	if len(fields) != 2 || !strings.EqualFold(fields[0], "WebPush") {
+		return v.VerifyHeader(authorization, audience)
+	}
+
+	publicKey, err := headerParam(h, "Crypto-Key", "p256ecdsa")
+	if err != nil {
+		return nil, vapidError(VAPIDInvalidKey, "%v", err)
+	}
+	return verifyVAPIDToken(strings.TrimSpace(fields[1]), publicKey, audience, v.now())
+}
+
+// VerifyHeader is like VerifyVAPIDHeader.
+func (v *VAPIDVerifier) VerifyHeader(authorization, audience string) (*VAPIDClaims, error) {
+	fields := strings.SplitN(authorization, " ", 2)
+	if len(fields) != 2 || !strings.EqualFold(fields[0], "vapid") {
+		return nil, vapidError(VAPIDMissing, "Authorization header does not use the vapid scheme")
+	}
+
+	var token, key string
+	for _, param := range strings.Split(fields[1], ",") {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch strings.ToLower(kv[0]) {
+		case "t":
+			token = kv[1]
+		case "k":
+			key = kv[1]
+		}
+	}
+	if token == "" || key == "" {
+		return nil, vapidError(VAPIDMalformed, "Authorization header must have t and k parameters")
+	}
+
+	publicKey, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(key, "="))
+	if err != nil {
+		return nil, vapidError(VAPIDInvalidKey, "k is not base64url encoded: %v", err)
+	}
+	return verifyVAPIDToken(token, publicKey, audience, v.now())
+}
+
+func verifyVAPIDToken(token string, publicKey []byte, audience string, now time.Time) (*VAPIDClaims, error) {
+	x, y := elliptic.Unmarshal(curve, publicKey)
+	if x == nil {
+		return nil, vapidError(VAPIDInvalidKey, "key is not an uncompressed P-256 public key")
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, vapidError(VAPIDMalformed, "token is not a JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "ES256" {
+		return nil, vapidError(VAPIDMalformed, "token is signed with %q, not ES256", header.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(sig) != 64 {
+		return nil, vapidError(VAPIDInvalidSignature, "signature is not 64 base64url encoded bytes")
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(&ecdsa.PublicKey{Curve: curve, X: x, Y: y}, hash[:], r, s) {
+		return nil, vapidError(VAPIDInvalidSignature, "signature does not match the key")
+	}
+
+	var claims vapidClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if claims.Audience != audience {
+		return nil, vapidError(VAPIDWrongAudience, "aud is %q, expected %q", claims.Audience, audience)
+	}
+	exp := time.Unix(claims.Expires, 0)
+	if !exp.After(now) {
+		return nil, vapidError(VAPIDExpired, "token expired at %v", exp.UTC())
+	}
+	if exp.After(now.Add(maxVAPIDLifetime)) {
+		return nil, vapidError(VAPIDExpiryTooLate, "exp %v is more than 24 hours from now", exp.UTC())
+	}
+	if err := validVAPIDSubject(claims.Subject); err != nil {
+		return nil, vapidError(VAPIDInvalidSubject, "%v", err)
+	}
+
+	return &VAPIDClaims{
+		Audience:  claims.Audience,
+		Expires:   exp,
+		Subject:   claims.Subject,
+		PublicKey: publicKey,
+	}, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return vapidError(VAPIDMalformed, "token is not base64url encoded: %v", err)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return vapidError(VAPIDMalformed, "token is not JSON: %v", err)
+	}
+	return nil
+}
+
+func validVAPIDSubject(subject string) error {
+	u, err := url.Parse(subject)
+	switch {
+	case err != nil:
+		return fmt.Errorf("subject %q is not a URI: %v", subject, err)
+	case u.Scheme == "mailto" && u.Opaque != "":
+		return nil
+	case u.Scheme == "https" && u.Host != "":
+		return nil
+	}
+	return fmt.Errorf("subject %q must be a mailto: or https: URI", subject)
+}
+
+// origin returns the scheme and host of a URL, which is the audience of the
+// VAPID token for a push service.
+func origin(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("endpoint %q is not an absolute URL", endpoint)
+	}
+	return u.Scheme + "://" + u.Host, nil
+}
@@ -0,0 +1,453 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package webpushtest provides a simulated push service, for testing code that
+// sends or receives Web Push messages.
+//
+//	s := webpushtest.NewServer()
+//	defer s.Close()
+//
+//	sub := &webpush.Subscription{Endpoint: s.Endpoint("device"), Key: key, Auth: auth}
+//	result, err := webpush.SendWithOptions(nil, sub, "Hello", nil)
+//
+//	// Pretend the user agent received the message.
+//	s.Acknowledge(result.Location)
+//
+// Messages can also be cancelled with webpush.PushMessage.Cancel before they
+// are acknowledged, which sets Message.Cancelled.
+//
+// User agents can subscribe at SubscribeURI. Messages sent to the push
+// resource of a subscription are delivered to GET requests on the
+// subscription resource, one per response with the push message resource in
+// the Content-Location header. Deleting a delivered message acknowledges it.
+package webpushtest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/googlechrome/push-encryption-go/webpush"
+)
+
+// DefaultLongPollTimeout is how long GET requests for messages and receipts
+// wait for something to return, unless Server.LongPollTimeout is set.
+const DefaultLongPollTimeout = 30 * time.Second
+
+// Message is a push message received by the Server.
+type Message struct {
+	// ID identifies the message, and is the last part of URI.
+	ID string
+	// URI is the push message resource, returned in the Location header.
+	URI string
+	// Endpoint is the push resource the message was sent to.
+	Endpoint string
+	Header   http.Header
+	Body     []byte
+	// ReceiptURI is the receipt subscription from the Push-Receipt header.
+	ReceiptURI string
+	// VAPID holds the claims of the VAPID token the message was sent with, if
+	// it had a valid one.
+	VAPID *webpush.VAPIDClaims
+	// Delivered is set once the message has been returned to a user agent.
+	Delivered bool
+	// Acknowledged is set once the user agent deletes the message after it
+	// was delivered, or Acknowledge is called for it.
+	Acknowledged bool
+	// Cancelled is set once the application server deletes the message before
+	// it was acknowledged.
+	Cancelled bool
+}
+
+// Server is a push service running on a local httptest.Server. Any path under
+// /push/ is accepted as a push resource.
+type Server struct {
+	*httptest.Server
+	// LongPollTimeout is how long GET requests for messages and receipts wait
+	// for something to return. DefaultLongPollTimeout is used if it is zero.
+	LongPollTimeout time.Duration
+	// RequireVAPID rejects messages without a valid VAPID token with 401
+	// Unauthorized. Otherwise only invalid tokens are rejected.
+	RequireVAPID bool
+
+	mu            sync.Mutex
+	messages      []*Message
+	subscriptions map[string]bool
+	receipts      map[string]*receiptSubscription
+	// newMessage is closed and replaced whenever a message arrives.
+	newMessage chan struct{}
+	closed     chan struct{}
+}
+
+type receiptSubscription struct {
+	pending []*webpush.Receipt
+	// notify is closed and replaced whenever a receipt is added.
+	notify chan struct{}
+}
+
+// NewServer starts and returns a new Server. The caller should call Close
+// when finished, to shut it down.
+func NewServer() *Server {
+	s := &Server{
+		subscriptions: make(map[string]bool),
+		receipts:      make(map[string]*receiptSubscription),
+		newMessage:    make(chan struct{}),
+		closed:        make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/subscribe", s.serveSubscribe)
+	mux.HandleFunc("/subscription/", s.serveSubscription)
+	mux.HandleFunc("/push/", s.servePush)
+	mux.HandleFunc("/m/", s.serveMessage)
+	mux.HandleFunc("/receipts", s.serveReceiptSubscribe)
+	mux.HandleFunc("/receipts/", s.serveReceipts)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Close ends any pending long polls, then shuts down the server.
+func (s *Server) Close() {
+	s.mu.Lock()
+	select {
+	case <-s.closed:
+	default:
+		close(s.closed)
+	}
+	s.mu.Unlock()
+	s.Server.Close()
+}
+
+// Endpoint returns the URL of a push resource on the server. Messages sent to
+// it are recorded under the given name.
+func (s *Server) Endpoint(name string) string {
+	return s.URL + "/push/" + name
+}
+
+// SubscribeURI returns the subscribe resource that user agents POST to in
+// order to create a subscription.
+func (s *Server) SubscribeURI() string {
+	return s.URL + "/subscribe"
+}
+
+// ReceiptSubscribeURI returns the receipt subscribe resource, for use with
+// webpush.NewReceiptSubscription.
+func (s *Server) ReceiptSubscribeURI() string {
+	return s.URL + "/receipts"
+}
+
+// Messages returns copies of the messages received so far, oldest first.
+func (s *Server) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	messages := make([]Message, len(s.messages))
+	for i, m := range s.messages {
+		messages[i] = *m
+	}
+	return messages
+}
+
+// Acknowledge simulates the user agent acknowledging the message with the
+// given push message resource URI, which sends a receipt if one was requested.
+func (s *Server) Acknowledge(uri string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := s.message(uri)
+	if m == nil {
+		return fmt.Errorf("webpushtest: no message %s", uri)
+	}
+	if m.Cancelled {
+		return fmt.Errorf("webpushtest: message %s was cancelled", uri)
+	}
+	s.acknowledge(m)
+	return nil
+}
+
+// The caller must hold s.mu.
+func (s *Server) acknowledge(m *Message) {
+	m.Acknowledged = true
+	if sub := s.receiptSubscription(m.ReceiptURI); sub != nil {
+		sub.pending = append(sub.pending, &webpush.Receipt{Message: m.URI})
+		close(sub.notify)
+		sub.notify = make(chan struct{})
+	}
+}
+
+func (s *Server) serveSubscribe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "the subscribe resource only accepts POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.mu.Lock()
+	id := newID()
+	s.subscriptions[id] = true
+	s.mu.Unlock()
+
+	w.Header().Add("Link", fmt.Sprintf(`<%s>; rel="urn:ietf:params:push"`, s.Endpoint(id)))
+	w.Header().Add("Link", fmt.Sprintf(`<%s>; rel="urn:ietf:params:push:receipt"`, s.ReceiptSubscribeURI()))
+	w.Header().Set("Location", s.URL+"/subscription/"+id)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// serveSubscription long polls for the next message sent to the push resource
+// of a subscription.
+func (s *Server) serveSubscription(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "subscriptions only accept GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/subscription/")
+	s.mu.Lock()
+	ok := s.subscriptions[id]
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	timer := time.NewTimer(s.longPollTimeout())
+	defer timer.Stop()
+
+	for {
+		s.mu.Lock()
+		m, notify := s.nextMessage(s.Endpoint(id)), s.newMessage
+		if m != nil {
+			m.Delivered = true
+		}
+		s.mu.Unlock()
+
+		if m != nil {
+			for _, h := range []string{"Content-Encoding", "Encryption", "Crypto-Key", "Topic", "Urgency"} {
+				if v := m.Header.Get(h); v != "" {
+					w.Header().Set(h, v)
+				}
+			}
+			w.Header().Set("Content-Location", m.URI)
+			w.WriteHeader(http.StatusOK)
+			w.Write(m.Body)
+			return
+		}
+
+		select {
+		case <-notify:
+		case <-timer.C:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-s.closed:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (s *Server) servePush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "push resources only accept POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Header.Get("TTL") == "" {
+		http.Error(w, "missing TTL header", http.StatusBadRequest)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	claims, err := webpush.VerifyVAPID(r)
+	if verr, ok := err.(*webpush.VAPIDError); ok && (s.RequireVAPID || verr.Code != webpush.VAPIDMissing) {
+		w.Header().Set("WWW-Authenticate", "vapid")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	receiptURI := r.Header.Get("Push-Receipt")
+	if receiptURI != "" && s.receiptSubscription(receiptURI) == nil {
+		http.Error(w, "unknown receipt subscription", http.StatusBadRequest)
+		return
+	}
+
+	id := newID()
+	m := &Message{
+		ID:         id,
+		URI:        s.URL + "/m/" + id,
+		Endpoint:   s.URL + r.URL.Path,
+		Header:     r.Header,
+		Body:       body,
+		ReceiptURI: receiptURI,
+		VAPID:      claims,
+	}
+	s.messages = append(s.messages, m)
+	close(s.newMessage)
+	s.newMessage = make(chan struct{})
+
+	w.Header().Set("Location", m.URI)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// serveMessage lets the user agent acknowledge a message that was delivered,
+// or the application server cancel one that hasn't been.
+func (s *Server) serveMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		http.Error(w, "push message resources only accept DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := s.message(s.URL + r.URL.Path)
+	if m == nil || m.Acknowledged || m.Cancelled {
+		http.NotFound(w, r)
+		return
+	}
+	if m.Delivered {
+		s.acknowledge(m)
+	} else {
+		m.Cancelled = true
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) serveReceiptSubscribe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "the receipt subscribe resource only accepts POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.mu.Lock()
+	id := newID()
+	s.receipts[id] = &receiptSubscription{notify: make(chan struct{})}
+	s.mu.Unlock()
+
+	w.Header().Set("Location", s.URL+"/receipts/"+id)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// serveReceipts long polls for receipts, streaming them as they arrive until
+// the timeout.
+func (s *Server) serveReceipts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "receipt subscriptions only accept GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.mu.Lock()
+	sub := s.receiptSubscription(s.URL + r.URL.Path)
+	s.mu.Unlock()
+	if sub == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	timer := time.NewTimer(s.longPollTimeout())
+	defer timer.Stop()
+
+	enc := json.NewEncoder(w)
+	started := false
+	for {
+		s.mu.Lock()
+		pending, notify := sub.pending, sub.notify
+		sub.pending = nil
+		s.mu.Unlock()
+
+		if len(pending) > 0 {
+			if !started {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusOK)
+				started = true
+			}
+			for _, receipt := range pending {
+				enc.Encode(receipt)
+			}
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+		}
+
+		select {
+		case <-notify:
+		case <-timer.C:
+			if !started {
+				w.WriteHeader(http.StatusNoContent)
+			}
+			return
+		case <-s.closed:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (s *Server) longPollTimeout() time.Duration {
+	if s.LongPollTimeout == 0 {
+		return DefaultLongPollTimeout
+	}
+	return s.LongPollTimeout
+}
+
+// nextMessage returns the oldest message waiting to be delivered from a push
+// resource. The caller must hold s.mu.
+func (s *Server) nextMessage(endpoint string) *Message {
+	for _, m := range s.messages {
+		if m.Endpoint == endpoint && !m.Delivered && !m.Acknowledged && !m.Cancelled {
+			return m
+		}
+	}
+	return nil
+}
+
+// The caller must hold s.mu.
+func (s *Server) message(uri string) *Message {
+	for _, m := range s.messages {
+		if m.URI == uri {
+			return m
+		}
+	}
+	return nil
+}
+
+// The caller must hold s.mu.
+func (s *Server) receiptSubscription(uri string) *receiptSubscription {
+	prefix := s.URL + "/receipts/"
+	if !strings.HasPrefix(uri, prefix) {
+		return nil
+	}
+	return s.receipts[strings.TrimPrefix(uri, prefix)]
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
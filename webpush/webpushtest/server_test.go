@@ -0,0 +1,72 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webpushtest
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"github.com/googlechrome/push-encryption-go/webpush"
+)
+
+func TestVAPID(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	sub := &webpush.Subscription{Endpoint: s.Endpoint("device")}
+	key, err := webpush.GenerateVAPIDKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vapid := &webpush.VAPID{PrivateKey: key, Subject: "mailto:push@example.com"}
+
+	result, err := webpush.SendWithOptions(nil, sub, "", &webpush.Options{VAPID: vapid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected 201 Created, got %d %s", result.StatusCode, result.Body)
+	}
+	m := s.Messages()[0]
+	if m.VAPID == nil || !bytes.Equal(m.VAPID.PublicKey, vapid.PublicKey()) {
+		t.Errorf("Expected the message to record the VAPID claims, got %+v", m.VAPID)
+	}
+
+	// Without VAPID the message is accepted, unless it is required.
+	if result, _ := webpush.SendWithOptions(nil, sub, "", nil); result.StatusCode != http.StatusCreated {
+		t.Errorf("Expected 201 Created without VAPID, got %d", result.StatusCode)
+	}
+	s.RequireVAPID = true
+	if result, _ := webpush.SendWithOptions(nil, sub, "", nil); result.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 Unauthorized without VAPID, got %d", result.StatusCode)
+	}
+
+	// A token for another push service is always rejected.
+	req, err := webpush.NewPushRequestWithOptions(&webpush.Subscription{Endpoint: "https://push.example.net/"}, "", &webpush.Options{VAPID: vapid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.URL, _ = req.URL.Parse(sub.Endpoint)
+	req.Host = ""
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 Unauthorized for the wrong audience, got %d", resp.StatusCode)
+	}
+}